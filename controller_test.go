@@ -0,0 +1,43 @@
+//go:build go1.20
+// +build go1.20
+
+package httpprom
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResponseController(t *testing.T) {
+	mux := NewServeMux(WithFlushTracking())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if err := rc.SetWriteDeadline(time.Now().Add(time.Minute)); err != nil {
+			t.Errorf("unexpected SetWriteDeadline error: %v", err)
+		}
+		io.WriteString(w, "event\n")
+		if err := rc.Flush(); err != nil {
+			t.Errorf("unexpected Flush error: %v", err)
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	resp, err := srv.Client().Get(srv.URL)
+	check(t, err)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	expect := `
+		# HELP http_server_response_flushes_total Total number of HTTP server response flushes.
+		# TYPE http_server_response_flushes_total counter
+		http_server_response_flushes_total{handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_response_flushes_total"))
+}
@@ -0,0 +1,54 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright 2021 Andrew Bursavich. All rights reserved.
+// Use of this source code is governed by The MIT License
+// which can be found in the LICENSE file.
+
+package httpprom
+
+import (
+	"errors"
+	"net/http"
+
+	"bursavich.dev/httpprom/internal/forked/prometheus/promhttp"
+)
+
+// The ErrorHandlerFunc type is an adapter to allow the use of ordinary
+// functions that return errors as HTTP handlers.
+//
+// If the function returns an error without writing a response, the error's
+// status is written with its status text as the body. The status is given by
+// a StatusCode() int method of the error, or any error it wraps, and is 500
+// (Internal Server Error) otherwise.
+type ErrorHandlerFunc func(http.ResponseWriter, *http.Request) error
+
+// ServeHTTP calls fn(w, r).
+func (fn ErrorHandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d, ok := w.(promhttp.Delegator)
+	if !ok {
+		d = promhttp.NewDelegator(w, nil, nil, nil, nil)
+		defer promhttp.ReleaseDelegator(d)
+	}
+	fn.serve(d, r)
+}
+
+func (fn ErrorHandlerFunc) serve(d promhttp.Delegator, r *http.Request) error {
+	err := fn(d, r)
+	if err != nil && !d.WroteHeader() && !d.Hijacked() {
+		code := errorStatus(err)
+		http.Error(d, http.StatusText(code), code)
+	}
+	return err
+}
+
+// errorStatus returns the response status code for the error. Codes outside
+// of 100-599, which would make WriteHeader panic, are replaced by 500.
+func errorStatus(err error) int {
+	var sc interface{ StatusCode() int }
+	if errors.As(err, &sc) {
+		if code := sc.StatusCode(); code >= 100 && code <= 599 {
+			return code
+		}
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,84 @@
+package httpprom
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type statusError int
+
+func (e statusError) Error() string   { return http.StatusText(int(e)) }
+func (e statusError) StatusCode() int { return int(e) }
+
+func TestErrorHandler(t *testing.T) {
+	mw := NewMiddleware(WithCode(), WithHandlerErrors(), WithoutPending())
+	handlers := map[string]func(http.ResponseWriter, *http.Request) error{
+		"ok": func(w http.ResponseWriter, r *http.Request) error {
+			return nil
+		},
+		"error": func(w http.ResponseWriter, r *http.Request) error {
+			return errors.New("boom")
+		},
+		"status": func(w http.ResponseWriter, r *http.Request) error {
+			return fmt.Errorf("wrapped: %w", statusError(http.StatusNotFound))
+		},
+		"written": func(w http.ResponseWriter, r *http.Request) error {
+			io.WriteString(w, "hello")
+			return errors.New("boom")
+		},
+	}
+	for name, fn := range handlers {
+		mw.ErrorHandler(name, fn).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	expect := `
+		# HELP http_server_handler_errors_total Total number of errors returned by HTTP server handlers.
+		# TYPE http_server_handler_errors_total counter
+		http_server_handler_errors_total{handler="error"} 1
+		http_server_handler_errors_total{handler="status"} 1
+		http_server_handler_errors_total{handler="written"} 1
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="ok"} 1
+		http_server_requests_total{code="200",handler="written"} 1
+		http_server_requests_total{code="404",handler="status"} 1
+		http_server_requests_total{code="500",handler="error"} 1
+	`
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)))
+}
+
+func TestErrorHandlerFunc(t *testing.T) {
+	fn := ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return errors.New("boom")
+	})
+	w := httptest.NewRecorder()
+	fn.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("unexpected status: got %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{errors.New("failed"), http.StatusInternalServerError},
+		{statusError(http.StatusNotFound), http.StatusNotFound},
+		{fmt.Errorf("wrapped: %w", statusError(http.StatusConflict)), http.StatusConflict},
+		{statusError(0), http.StatusInternalServerError},
+		{statusError(-1), http.StatusInternalServerError},
+		{statusError(1000), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := errorStatus(tt.err); got != tt.code {
+			t.Errorf("errorStatus(%v) = %d; want %d", tt.err, got, tt.code)
+		}
+	}
+}
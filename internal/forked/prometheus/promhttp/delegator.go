@@ -20,6 +20,8 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const (
@@ -35,13 +37,38 @@ type Delegator interface {
 
 	Status() int
 	Written() int64
+	WroteHeader() bool
+	WroteHeaderAt() time.Time
+	FlushedAt() time.Time
+	Hijacked() bool
+	Unwrap() http.ResponseWriter
+	Err() error
+
+	base() *responseWriterDelegator
 }
 
 type responseWriterDelegator struct {
 	http.ResponseWriter
 
-	status  int
-	written int64
+	now           func() time.Time
+	onHijack      func(net.Conn) net.Conn
+	onFlush       func()
+	onPush        func(error)
+	status        int
+	written       int64
+	wroteHeader   bool
+	wroteHeaderAt time.Time
+	flushedAt     time.Time
+	hijacked      bool
+	err           error
+
+	// NB: the delegator picked for the writer's interfaces is kept for reuse
+	id        int
+	delegator Delegator
+}
+
+func (r *responseWriterDelegator) base() *responseWriterDelegator {
+	return r
 }
 
 func (r *responseWriterDelegator) Status() int {
@@ -52,14 +79,70 @@ func (r *responseWriterDelegator) Written() int64 {
 	return r.written
 }
 
+func (r *responseWriterDelegator) WroteHeader() bool {
+	return r.wroteHeader
+}
+
+// WroteHeaderAt returns the time of the first header or body write.
+// It's zero if nothing has been written or the delegator has no clock.
+func (r *responseWriterDelegator) WroteHeaderAt() time.Time {
+	return r.wroteHeaderAt
+}
+
+// FlushedAt returns the time of the first flush.
+// It's zero if the response hasn't been flushed or the delegator has no clock.
+func (r *responseWriterDelegator) FlushedAt() time.Time {
+	return r.flushedAt
+}
+
+func (r *responseWriterDelegator) markWrite() {
+	if r.now != nil && r.wroteHeaderAt.IsZero() {
+		r.wroteHeaderAt = r.now()
+	}
+}
+
+func (r *responseWriterDelegator) Hijacked() bool {
+	return r.hijacked
+}
+
+// Err returns the first error returned by Write or ReadFrom, if any.
+// Handlers may check it by asserting that their response writer has
+// an Err method.
+func (r *responseWriterDelegator) Err() error {
+	return r.err
+}
+
+// Unwrap returns the underlying response writer, which lets handlers reach
+// its optional interfaces (e.g. via http.ResponseController).
+func (r *responseWriterDelegator) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 func (r *responseWriterDelegator) WriteHeader(code int) {
-	r.status = code
+	// Like net/http, only the first final status is sent, so superfluous
+	// calls must not change the recorded status. Informational statuses
+	// may precede the final status and don't change the recorded status,
+	// so an implicit 200 is still recorded if no final status is written.
+	if !r.wroteHeader && (code < 100 || code > 199 || code == http.StatusSwitchingProtocols) {
+		r.status = code
+		r.wroteHeader = true
+	}
+	r.markWrite()
 	r.ResponseWriter.WriteHeader(code)
 }
 
 func (r *responseWriterDelegator) Write(b []byte) (int, error) {
+	// Writing without a final status implicitly sends 200.
+	if !r.wroteHeader {
+		r.status = http.StatusOK
+		r.wroteHeader = true
+	}
+	r.markWrite()
 	n, err := r.ResponseWriter.Write(b)
 	r.written += int64(n)
+	if err != nil && r.err == nil {
+		r.err = err
+	}
 	return n, err
 }
 
@@ -73,27 +156,59 @@ func (d closeNotifierDelegator) CloseNotify() <-chan bool {
 type flusherDelegator struct{ *responseWriterDelegator }
 
 func (d flusherDelegator) Flush() {
+	// Like Write, flushing without a final status implicitly sends 200.
+	if !d.wroteHeader {
+		d.status = http.StatusOK
+		d.wroteHeader = true
+	}
+	d.markWrite()
+	if d.now != nil && d.flushedAt.IsZero() {
+		d.flushedAt = d.now()
+	}
+	if d.onFlush != nil {
+		d.onFlush()
+	}
 	d.ResponseWriter.(http.Flusher).Flush()
 }
 
 type hijackerDelegator struct{ *responseWriterDelegator }
 
 func (d hijackerDelegator) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return d.ResponseWriter.(http.Hijacker).Hijack()
+	conn, rw, err := d.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil {
+		d.hijacked = true
+		if d.onHijack != nil {
+			conn = d.onHijack(conn)
+		}
+	}
+	return conn, rw, err
 }
 
 type readerFromDelegator struct{ *responseWriterDelegator }
 
 func (d readerFromDelegator) ReadFrom(re io.Reader) (int64, error) {
+	// Like Write, reading without a final status implicitly sends 200.
+	if !d.wroteHeader {
+		d.status = http.StatusOK
+		d.wroteHeader = true
+	}
+	d.markWrite()
 	n, err := d.ResponseWriter.(io.ReaderFrom).ReadFrom(re)
 	d.written += n
+	if err != nil && d.err == nil {
+		d.err = err
+	}
 	return n, err
 }
 
 type pusherDelegator struct{ *responseWriterDelegator }
 
 func (d pusherDelegator) Push(target string, opts *http.PushOptions) error {
-	return d.ResponseWriter.(http.Pusher).Push(target, opts)
+	err := d.ResponseWriter.(http.Pusher).Push(target, opts)
+	if d.onPush != nil {
+		d.onPush(err)
+	}
+	return err
 }
 
 var pickDelegator = make([]func(*responseWriterDelegator) Delegator, 32)
@@ -325,12 +440,17 @@ func init() {
 	}
 }
 
-func NewDelegator(w http.ResponseWriter) Delegator {
-	d := &responseWriterDelegator{
-		ResponseWriter: w,
-		status:         http.StatusOK,
-	}
+var delegatorPool = sync.Pool{
+	New: func() interface{} { return new(responseWriterDelegator) },
+}
 
+// NewDelegator returns a delegator for w. If now is non-nil,
+// it's used to record the time of the first write. If onHijack is non-nil,
+// it's used to wrap the connection returned by a successful hijack. If onFlush
+// is non-nil, it's called each time the response is flushed. If onPush is
+// non-nil, it's called with the result of each push.
+// The delegator may be released by ReleaseDelegator when it's no longer used.
+func NewDelegator(w http.ResponseWriter, now func() time.Time, onHijack func(net.Conn) net.Conn, onFlush func(), onPush func(error)) Delegator {
 	id := 0
 	//nolint:staticcheck // Ignore SA1019. http.CloseNotifier is deprecated but we keep it here to not break existing users.
 	if _, ok := w.(http.CloseNotifier); ok {
@@ -349,5 +469,28 @@ func NewDelegator(w http.ResponseWriter) Delegator {
 		id += pusher
 	}
 
-	return pickDelegator[id](d)
+	d := delegatorPool.Get().(*responseWriterDelegator)
+	*d = responseWriterDelegator{
+		ResponseWriter: w,
+		now:            now,
+		onHijack:       onHijack,
+		onFlush:        onFlush,
+		onPush:         onPush,
+		status:         http.StatusOK,
+		id:             d.id,
+		delegator:      d.delegator,
+	}
+	if d.delegator == nil || d.id != id {
+		d.id = id
+		d.delegator = pickDelegator[id](d)
+	}
+	return d.delegator
+}
+
+// ReleaseDelegator returns a delegator created by NewDelegator to a pool,
+// from which it may be reused. It must not be used after it's released.
+func ReleaseDelegator(d Delegator) {
+	r := d.base()
+	*r = responseWriterDelegator{id: r.id, delegator: r.delegator}
+	delegatorPool.Put(r)
 }
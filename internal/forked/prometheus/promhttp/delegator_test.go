@@ -0,0 +1,18 @@
+package promhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func BenchmarkDelegator(b *testing.B) {
+	w := httptest.NewRecorder()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d := NewDelegator(w, nil, nil, nil, nil)
+		d.WriteHeader(http.StatusOK)
+		ReleaseDelegator(d)
+	}
+}
@@ -7,6 +7,8 @@
 package httpprom
 
 import (
+	"context"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,31 +19,151 @@ func init() {
 		lower := strings.ToLower(method)
 		methodTable[method] = lower
 		methodTable[lower] = lower
+		upperMethodTable[method] = method
+		upperMethodTable[lower] = method
 	}
 	for _, code := range codes {
 		codeTable[code] = strconv.Itoa(code)
 	}
+	for _, mediaType := range contentTypes {
+		contentTypeTable[mediaType] = true
+	}
 }
 
 func lookupMethod(method string) string {
 	s, ok := methodTable[method]
 	if !ok {
+		if m, ok := foldMethod(method); ok {
+			return methodTable[m]
+		}
 		return strings.ToLower(method)
 	}
 	return s
 }
 
+func lookupUpperMethod(method string) string {
+	s, ok := upperMethodTable[method]
+	if !ok {
+		if m, ok := foldMethod(method); ok {
+			return m
+		}
+		return strings.ToUpper(method)
+	}
+	return s
+}
+
+// foldMethod returns the standard method that's equal to the given method
+// under case folding (e.g. "GET" for "Get"), without allocating.
+func foldMethod(method string) (string, bool) {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return m, true
+		}
+	}
+	return "", false
+}
+
 func lookupCode(code int) string {
 	s, ok := codeTable[code]
 	if !ok {
+		if code < 100 || code > 599 {
+			return "invalid"
+		}
 		return strconv.Itoa(code)
 	}
 	return s
 }
 
+func lookupProto(proto string) string {
+	s, ok := protoTable[proto]
+	if !ok {
+		return proto
+	}
+	return s
+}
+
+func lookupScheme(r *http.Request) string {
+	if r.TLS != nil ||
+		strings.EqualFold(r.URL.Scheme, "https") ||
+		strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		return "https"
+	}
+	return "http"
+}
+
+func lookupCancellation(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case context.Canceled:
+		return "canceled"
+	case context.DeadlineExceeded:
+		return "deadline_exceeded"
+	default:
+		return "unknown"
+	}
+}
+
+func lookupOutcome(code int) string {
+	if code >= 500 {
+		return "error"
+	}
+	return "success"
+}
+
+func lookupContentType(contentType string, allowed map[string]bool) string {
+	if contentType == "" {
+		return "none"
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || !allowed[mediaType] {
+		return "other"
+	}
+	return mediaType
+}
+
+func lookupCodeClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return codeClasses[code/100-1]
+}
+
+var protoTable = map[string]string{
+	"HTTP/1.0": "HTTP/1.0",
+	"HTTP/1.1": "HTTP/1.1",
+	"HTTP/2":   "HTTP/2.0",
+	"HTTP/2.0": "HTTP/2.0",
+	"HTTP/3":   "HTTP/3.0",
+	"HTTP/3.0": "HTTP/3.0",
+}
+
+var codeClasses = []string{"1xx", "2xx", "3xx", "4xx", "5xx"}
+
+var (
+	contentTypeTable = make(map[string]bool)
+	contentTypes     = []string{
+		"application/grpc",
+		"application/json",
+		"application/octet-stream",
+		"application/protobuf",
+		"application/x-protobuf",
+		"application/x-www-form-urlencoded",
+		"application/xml",
+		"multipart/form-data",
+		"text/css",
+		"text/event-stream",
+		"text/html",
+		"text/javascript",
+		"text/plain",
+		"text/xml",
+	}
+)
+
 var (
-	methodTable = make(map[string]string)
-	methods     = []string{
+	methodTable      = make(map[string]string)
+	upperMethodTable = make(map[string]string)
+	methods          = []string{
 		http.MethodGet,
 		http.MethodHead,
 		http.MethodPost,
@@ -0,0 +1,194 @@
+package httpprom
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLookupMethod(t *testing.T) {
+	tests := []struct {
+		method string
+		lower  string
+		upper  string
+	}{
+		{"GET", "get", "GET"},
+		{"get", "get", "GET"},
+		{"PATCH", "patch", "PATCH"},
+		{"Get", "get", "GET"},
+		{"dELETE", "delete", "DELETE"},
+		{"Custom", "custom", "CUSTOM"},
+	}
+	for _, tt := range tests {
+		if got := lookupMethod(tt.method); got != tt.lower {
+			t.Errorf("lookupMethod(%q) = %q; want %q", tt.method, got, tt.lower)
+		}
+		if got := lookupUpperMethod(tt.method); got != tt.upper {
+			t.Errorf("lookupUpperMethod(%q) = %q; want %q", tt.method, got, tt.upper)
+		}
+	}
+}
+
+func BenchmarkLookupMethod(b *testing.B) {
+	benchmarks := []struct {
+		name   string
+		lookup func(string) string
+		method string
+	}{
+		{"Canonical", lookupMethod, "GET"},
+		{"Lower", lookupMethod, "get"},
+		{"Mixed", lookupMethod, "Get"},
+		{"MixedToLower", strings.ToLower, "Get"}, // NB: the previous path for mixed case
+		{"Custom", lookupMethod, "Custom"},
+	}
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bb.lookup(bb.method)
+			}
+		})
+	}
+}
+
+func TestLookupCode(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{0, "invalid"},
+		{99, "invalid"},
+		{100, "100"},
+		{200, "200"},
+		{299, "299"},
+		{599, "599"},
+		{600, "invalid"},
+	}
+	for _, tt := range tests {
+		if got := lookupCode(tt.code); got != tt.want {
+			t.Errorf("lookupCode(%d) = %q; want %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestLookupCodeClass(t *testing.T) {
+	tests := []struct {
+		code  int
+		class string
+	}{
+		{0, "unknown"},
+		{99, "unknown"},
+		{100, "1xx"},
+		{200, "2xx"},
+		{204, "2xx"},
+		{301, "3xx"},
+		{404, "4xx"},
+		{499, "4xx"},
+		{500, "5xx"},
+		{599, "5xx"},
+		{600, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := lookupCodeClass(tt.code); got != tt.class {
+			t.Errorf("lookupCodeClass(%d) = %q; want %q", tt.code, got, tt.class)
+		}
+	}
+}
+
+func TestLookupProto(t *testing.T) {
+	tests := []struct {
+		proto string
+		want  string
+	}{
+		{"HTTP/1.1", "HTTP/1.1"},
+		{"HTTP/2", "HTTP/2.0"},
+		{"HTTP/2.0", "HTTP/2.0"},
+		{"SPDY/3", "SPDY/3"},
+	}
+	for _, tt := range tests {
+		if got := lookupProto(tt.proto); got != tt.want {
+			t.Errorf("lookupProto(%q) = %q; want %q", tt.proto, got, tt.want)
+		}
+	}
+}
+
+func TestLookupScheme(t *testing.T) {
+	secure := httptest.NewRequest("GET", "/", nil)
+	secure.TLS = &tls.ConnectionState{}
+	abs := httptest.NewRequest("GET", "https://example.com/", nil)
+	abs.TLS = nil
+	fwd := httptest.NewRequest("GET", "/", nil)
+	fwd.Header.Set("X-Forwarded-Proto", "HTTPS")
+	tests := []struct {
+		name   string
+		req    *http.Request
+		scheme string
+	}{
+		{"Plain", httptest.NewRequest("GET", "/", nil), "http"},
+		{"TLS", secure, "https"},
+		{"URL", abs, "https"},
+		{"Forwarded", fwd, "https"},
+	}
+	for _, tt := range tests {
+		if got := lookupScheme(tt.req); got != tt.scheme {
+			t.Errorf("%s: lookupScheme() = %q; want %q", tt.name, got, tt.scheme)
+		}
+	}
+}
+
+func TestLookupCancellation(t *testing.T) {
+	tests := []struct {
+		err          error
+		cancellation string
+	}{
+		{nil, "ok"},
+		{context.Canceled, "canceled"},
+		{context.DeadlineExceeded, "deadline_exceeded"},
+	}
+	for _, tt := range tests {
+		if got := lookupCancellation(tt.err); got != tt.cancellation {
+			t.Errorf("lookupCancellation(%v) = %q; want %q", tt.err, got, tt.cancellation)
+		}
+	}
+}
+
+func TestLookupContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        string
+	}{
+		{"", "none"},
+		{"application/json", "application/json"},
+		{"Application/JSON; charset=utf-8", "application/json"},
+		{"application/x-protobuf; proto=foo.Bar", "application/x-protobuf"},
+		{"application/vnd.custom+json", "other"},
+		{"invalid;;", "other"},
+	}
+	for _, tt := range tests {
+		if got := lookupContentType(tt.contentType, contentTypeTable); got != tt.want {
+			t.Errorf("lookupContentType(%q) = %q; want %q", tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestLookupOutcome(t *testing.T) {
+	tests := []struct {
+		code    int
+		outcome string
+	}{
+		{100, "success"},
+		{200, "success"},
+		{404, "success"},
+		{499, "success"},
+		{500, "error"},
+		{503, "error"},
+	}
+	for _, tt := range tests {
+		if got := lookupOutcome(tt.code); got != tt.outcome {
+			t.Errorf("lookupOutcome(%d) = %q; want %q", tt.code, got, tt.outcome)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright 2021 Andrew Bursavich. All rights reserved.
+// Use of this source code is governed by The MIT License
+// which can be found in the LICENSE file.
+
+package httpprom
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsHandler returns a handler that serves only the middleware's metrics
+// from a dedicated registry. It serves the OpenMetrics text format, which
+// includes exemplars, if it's accepted by the client. Counters don't have
+// _created samples, since the prometheus client this module requires
+// doesn't support them.
+func (mw *Middleware) MetricsHandler() http.Handler {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(mw.Collector())
+	return promhttp.HandlerFor(reg, promhttp.HandlerOpts{EnableOpenMetrics: true})
+}
@@ -0,0 +1,2672 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright 2021 Andrew Bursavich. All rights reserved.
+// Use of this source code is governed by The MIT License
+// which can be found in the LICENSE file.
+
+package httpprom
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"bursavich.dev/httpprom/internal/forked/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// An Option changes the default behavior of a Middleware or ServeMux.
+type Option interface {
+	applyOpt(*Middleware)
+}
+
+type optFunc func(*Middleware)
+
+func (fn optFunc) applyOpt(mw *Middleware) { fn(mw) }
+
+// WithCode returns an option that adds a status code label to metrics.
+func WithCode() Option {
+	return optFunc(func(mw *Middleware) { mw.code = true })
+}
+
+// WithCodeMapper returns an option that maps each status code to the value
+// of the code label with the given function (e.g. to group 404 and 410).
+// It should map codes into a fixed set of buckets, such as "4xx" or
+// "client_error", rather than format arbitrary codes set by handlers.
+func WithCodeMapper(fn func(code int) string) Option {
+	return optFunc(func(mw *Middleware) { mw.codeMapper = fn })
+}
+
+// WithCodeClass returns an option that adds a status code class label
+// (e.g. "2xx") to metrics.
+func WithCodeClass() Option {
+	return optFunc(func(mw *Middleware) { mw.codeClass = true })
+}
+
+// WithHost returns an option that adds a host label to metrics.
+// Since arbitrary hosts have unbounded cardinality, it should be used
+// with WithHostFilter unless hosts are known to be bounded.
+func WithHost() Option {
+	return optFunc(func(mw *Middleware) { mw.host = true })
+}
+
+// WithHostFilter returns an option that maps each request's host to
+// the value of the host label. It may be used to normalize or allowlist hosts.
+func WithHostFilter(fn func(host string) string) Option {
+	return optFunc(func(mw *Middleware) { mw.hostFilter = fn })
+}
+
+// WithMaxLabelLength returns an option that truncates the values of the
+// handler and host labels to at most n runes, replacing the end of truncated
+// values with an ellipsis. If n isn't positive, values aren't truncated.
+func WithMaxLabelLength(n int) Option {
+	return optFunc(func(mw *Middleware) { mw.maxLabelLen = n })
+}
+
+// WithScheme returns an option that adds a scheme label ("http" or "https")
+// to metrics. Requests received over TLS or forwarded by a proxy with an
+// X-Forwarded-Proto header of "https" are labeled "https".
+func WithScheme() Option {
+	return optFunc(func(mw *Middleware) { mw.scheme = true })
+}
+
+// WithProtocol returns an option that adds a protocol label
+// (e.g. "HTTP/1.1" or "HTTP/2.0") to metrics.
+func WithProtocol() Option {
+	return optFunc(func(mw *Middleware) { mw.proto = true })
+}
+
+// WithTraceIDLabel returns an option that adds a trace label to request
+// metrics, with a value derived from each request's context by the given
+// function (e.g. whether the span is sampled). It's called once per request.
+// It must never return the trace ID itself, which is unique to each request,
+// only a property of the trace with a few possible values.
+func WithTraceIDLabel(fn func(context.Context) string) Option {
+	return optFunc(func(mw *Middleware) { mw.traceFunc = fn })
+}
+
+// WithCancellation returns an option that adds a cancellation label to request
+// metrics, which is "canceled" or "deadline_exceeded" if the request's context
+// was canceled or its deadline was exceeded before the handler returned, and
+// "ok" otherwise.
+func WithCancellation() Option {
+	return optFunc(func(mw *Middleware) { mw.cancellation = true })
+}
+
+// WithRequestContentType returns an option that adds a content_type label to
+// request metrics, which is the media type of the request's Content-Type
+// header without parameters (e.g. "application/json"). It's "none" if the
+// header is empty, and "other" if it's invalid or not in the allowlist.
+func WithRequestContentType() Option {
+	return optFunc(func(mw *Middleware) { mw.reqContent = true })
+}
+
+// WithResponseContentType returns an option that adds a
+// response_content_type label to request metrics, which is the media type of
+// the response's Content-Type header, like the content_type label of
+// WithRequestContentType. It's recorded from the header map after the handler
+// returns, so it's "none" if the handler didn't set it, even though the server
+// may sniff the content type and send it.
+func WithResponseContentType() Option {
+	return optFunc(func(mw *Middleware) { mw.respContent = true })
+}
+
+// WithHeaderLabel returns an option that adds a label with the given name to
+// request metrics, which is the value of the request's header with the given
+// name. Values that aren't allowed are labeled as "other". A missing header's
+// value is empty, so it's recorded only if the empty string is allowed. It may
+// be given more than once to add multiple labels. It panics if the label name
+// isn't valid.
+func WithHeaderLabel(labelName, headerName string, allowed []string) Option {
+	if !labelNameRE.MatchString(labelName) {
+		panic(fmt.Sprintf("httpprom: invalid label name: %q", labelName))
+	}
+	key := http.CanonicalHeaderKey(headerName)
+	return customLabelOpt(labelName, func(r *http.Request) string { return r.Header.Get(key) }, allowed)
+}
+
+// WithContextLabel returns an option that adds a label with the given name to
+// request metrics, which is the value returned by fn for the request's context
+// (e.g. a tenant set by authentication middleware). Values that aren't allowed
+// are labeled as "other". It may be given more than once to add multiple
+// labels, which are ordered with those of WithHeaderLabel as they're given.
+// It panics if the label name isn't valid.
+func WithContextLabel(labelName string, fn func(context.Context) string, allowed []string) Option {
+	if !labelNameRE.MatchString(labelName) {
+		panic(fmt.Sprintf("httpprom: invalid label name: %q", labelName))
+	}
+	return customLabelOpt(labelName, func(r *http.Request) string { return fn(r.Context()) }, allowed)
+}
+
+// customLabel is a label whose value is from a request
+// and is collapsed to "other" if it isn't allowed.
+type customLabel struct {
+	name    string
+	value   func(*http.Request) string
+	allowed map[string]bool
+}
+
+func customLabelOpt(name string, value func(*http.Request) string, allowed []string) Option {
+	table := make(map[string]bool, len(allowed))
+	for _, v := range allowed {
+		table[v] = true
+	}
+	l := customLabel{name: name, value: value, allowed: table}
+	return optFunc(func(mw *Middleware) { mw.custom = append(mw.custom, l) })
+}
+
+// WithContentTypeAllowlist returns an option that sets the media types that
+// are recorded by content type labels. Any other media type is labeled as
+// "other". By default, common media types of APIs and web pages are allowed.
+func WithContentTypeAllowlist(mediaTypes ...string) Option {
+	return optFunc(func(mw *Middleware) { mw.contentTypes = mediaTypes })
+}
+
+// WithOutcome returns an option that adds an outcome label to request metrics,
+// which is "error" if the status code is 5xx and "success" otherwise. It's
+// coarser than the code and code class labels, with only two values.
+func WithOutcome() Option {
+	return optFunc(func(mw *Middleware) { mw.outcome = true })
+}
+
+// WithDefaultHandlerName returns an option that sets the value of the handler
+// label for handlers whose name is empty, whether given or derived from the
+// request.
+func WithDefaultHandlerName(name string) Option {
+	return optFunc(func(mw *Middleware) { mw.defaultName = name })
+}
+
+// WithoutHandlerLabel returns an option that removes the handler label
+// from metrics.
+func WithoutHandlerLabel() Option {
+	return optFunc(func(mw *Middleware) { mw.noHandler = true })
+}
+
+// WithNotFoundHandler returns an option that instruments requests to a
+// ServeMux that don't match any registered pattern, using "not_found" as the
+// value of their handler label. They're still answered by the ServeMux, so a
+// request whose path only matches patterns for other methods gets 405 (Method
+// Not Allowed) with an Allow header. It has no effect on a Middleware.
+func WithNotFoundHandler() Option {
+	return optFunc(func(mw *Middleware) { mw.notFound = true })
+}
+
+// WithPatternAsName returns an option that always uses the pattern with which
+// a handler is registered to a ServeMux as the value of its handler label,
+// even if another name is given by WithName or WithHandlerName.
+// It has no effect on a Middleware.
+func WithPatternAsName() Option {
+	return optFunc(func(mw *Middleware) { mw.patternName = true })
+}
+
+// WithPathDepth returns an option that uses up to the first n segments of the
+// request's URL path as the value of the handler label of a handler registered
+// to a ServeMux with a prefix pattern (e.g. "/api/"), followed by a slash if
+// the path has more segments. For example, with a depth of 2, requests for
+// "/api/users/1" and "/api/users" are labeled as "/api/users/" and
+// "/api/users". It has no effect on patterns that aren't prefixes or that have
+// n or more segments, on a Middleware, or if WithPatternAsName or
+// WithHandlerName is given. It panics if n isn't positive.
+//
+// WARNING: URL paths may be chosen by clients. Unless the set of paths under
+// a prefix is known to be small, the depth should be limited to the segments
+// that are.
+func WithPathDepth(n int) Option {
+	if n <= 0 {
+		panic(fmt.Sprintf("httpprom: invalid path depth: %d", n))
+	}
+	return optFunc(func(mw *Middleware) { mw.pathDepth = n })
+}
+
+// WithMethod returns an option that adds a method label to metrics.
+func WithMethod() Option {
+	return optFunc(func(mw *Middleware) { mw.method = true })
+}
+
+// WithoutPending returns an option that removes the pending requests gauge.
+func WithoutPending() Option {
+	return optFunc(func(mw *Middleware) { mw.noPending = true })
+}
+
+// WithGlobalInFlight returns an option that adds an unlabeled gauge of all
+// requests currently in flight, regardless of the pending requests gauge.
+func WithGlobalInFlight() Option {
+	return optFunc(func(mw *Middleware) { mw.globalInFlight = true })
+}
+
+// WithServerErrors returns an option that adds a counter of errors logged by
+// an http.Server with a kind label, but no handler label. The server must use
+// the logger returned by ServerErrorCounter as its ErrorLog.
+func WithServerErrors() Option {
+	return optFunc(func(mw *Middleware) { mw.serverErrs = true })
+}
+
+// WithInfoMetric returns an option that adds a gauge with the given name and
+// const labels (e.g. version and commit) whose value is always 1, so that
+// other metrics may be joined with it. It panics if the name isn't a valid
+// metric name.
+func WithInfoMetric(name string, labels prometheus.Labels) Option {
+	if !metricNameRE.MatchString(name) {
+		panic(fmt.Sprintf("httpprom: invalid metric name: %q", name))
+	}
+	return optFunc(func(mw *Middleware) {
+		mw.infos = append(mw.infos, infoMetric{name: name, labels: labels})
+	})
+}
+
+// WithDuration returns an option that adds a request duration histogram.
+func WithDuration() Option {
+	return optFunc(func(mw *Middleware) { mw.duration = true })
+}
+
+// WithDurationUnit returns an option that sets the unit of the request
+// duration histogram and summary to time.Second (the default),
+// time.Millisecond, or time.Microsecond. The suffix of their names is "_ms"
+// or "_us" instead of "_seconds", unless their names are overridden, and the
+// buckets of the histogram are in the unit. It's intended for compatibility
+// with existing dashboards, since Prometheus recommends base units.
+// It panics if the unit isn't supported.
+func WithDurationUnit(unit time.Duration) Option {
+	if _, ok := durationUnits[unit]; !ok {
+		panic(fmt.Sprintf("httpprom: unsupported duration unit: %v", unit))
+	}
+	return optFunc(func(mw *Middleware) { mw.durationUnit = unit })
+}
+
+// durationUnits are the name suffixes and help texts of duration units.
+var durationUnits = map[time.Duration]struct{ suffix, help string }{
+	time.Second:      {"seconds", "seconds"},
+	time.Millisecond: {"ms", "milliseconds"},
+	time.Microsecond: {"us", "microseconds"},
+}
+
+// WithDurationBuckets returns an option that sets the buckets of the
+// request duration histogram. The buckets must be in increasing order and
+// in the unit set by WithDurationUnit. If buckets is empty,
+// prometheus.DefBuckets is used, converted to the unit.
+func WithDurationBuckets(buckets []float64) Option {
+	checkBuckets("duration", buckets)
+	return optFunc(func(mw *Middleware) { mw.durationBuckets = buckets })
+}
+
+// ExponentialDurationBuckets returns count buckets for WithDurationBuckets,
+// where the lowest bucket has an upper bound of start seconds and each
+// following bucket's upper bound is factor times the previous one's.
+// For example, ExponentialDurationBuckets(10e-6, 2, 12) returns buckets
+// from 10µs to about 20ms. It panics if count isn't positive, start isn't
+// positive, or factor isn't greater than 1.
+func ExponentialDurationBuckets(start, factor float64, count int) []float64 {
+	return ExponentialBuckets(start, factor, count)
+}
+
+// LinearBuckets returns count buckets, where the lowest bucket has an upper
+// bound of start and each following bucket's upper bound is width more than
+// the previous one's. It panics if count or width isn't positive.
+func LinearBuckets(start, width float64, count int) []float64 {
+	if count < 1 {
+		panic(fmt.Sprintf("httpprom: linear bucket count must be positive: %d", count))
+	}
+	if width <= 0 {
+		panic(fmt.Sprintf("httpprom: linear bucket width must be positive: %v", width))
+	}
+	return prometheus.LinearBuckets(start, width, count)
+}
+
+// ExponentialBuckets returns count buckets, where the lowest bucket has an
+// upper bound of start and each following bucket's upper bound is factor times
+// the previous one's. It panics if count or start isn't positive, or factor
+// isn't greater than 1.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	if count < 1 {
+		panic(fmt.Sprintf("httpprom: exponential bucket count must be positive: %d", count))
+	}
+	if start <= 0 {
+		panic(fmt.Sprintf("httpprom: exponential bucket start must be positive: %v", start))
+	}
+	if factor <= 1 {
+		panic(fmt.Sprintf("httpprom: exponential bucket factor must be greater than 1: %v", factor))
+	}
+	return prometheus.ExponentialBuckets(start, factor, count)
+}
+
+// WithDurationSummary returns an option that adds a request duration
+// summary with the given quantile objectives, as a map of quantiles to
+// their absolute errors.
+func WithDurationSummary(objectives map[float64]float64) Option {
+	return optFunc(func(mw *Middleware) {
+		mw.durationSummary = true
+		mw.durationObjectives = objectives
+	})
+}
+
+// WithDurationSampleRate returns an option that observes only the given
+// fraction of requests, chosen at random, in the request duration histogram and
+// summary, to reduce their overhead. Other metrics observe every request.
+// Quantiles derived from sampled observations are approximate and the counts
+// and sums of the duration metrics are scaled down by the rate. It panics if
+// the rate isn't in (0, 1].
+func WithDurationSampleRate(rate float64) Option {
+	if !(rate > 0 && rate <= 1) {
+		panic(fmt.Sprintf("httpprom: invalid duration sample rate: %v", rate))
+	}
+	return optFunc(func(mw *Middleware) { mw.sampleRate = rate })
+}
+
+// WithDurationUntilFirstFlush returns an option that measures the request
+// duration until the response is first flushed, if it's flushed, rather than
+// until the handler returns. It keeps the time that streaming and long-polling
+// handlers spend waiting out of the duration histogram and summary.
+func WithDurationUntilFirstFlush() Option {
+	return optFunc(func(mw *Middleware) { mw.untilFlush = true })
+}
+
+// WithTTFB returns an option that adds a histogram of the time to first byte,
+// which is the time until the response header or body is first written.
+func WithTTFB() Option {
+	return optFunc(func(mw *Middleware) { mw.ttfb = true })
+}
+
+// WithHandlerErrors returns an option that adds a counter of errors returned
+// by handlers of type ErrorHandlerFunc.
+func WithHandlerErrors() Option {
+	return optFunc(func(mw *Middleware) { mw.handlerErrors = true })
+}
+
+// WithEmptyResponseTracking returns an option that adds a counter of
+// responses with a 200 (OK) status and an empty body, which may indicate
+// a handler bug. Responses to HEAD requests and hijacked connections aren't
+// counted.
+func WithEmptyResponseTracking() Option {
+	return optFunc(func(mw *Middleware) { mw.emptyResponses = true })
+}
+
+// WithWriteErrorTracking returns an option that adds a counter of responses
+// whose writes failed, such as when the client goes away mid-stream.
+func WithWriteErrorTracking() Option {
+	return optFunc(func(mw *Middleware) { mw.writeErrs = true })
+}
+
+// WithPushTracking returns an option that adds counters of HTTP/2 server
+// pushes and of pushes that failed (e.g. because the client disabled push).
+func WithPushTracking() Option {
+	return optFunc(func(mw *Middleware) { mw.pushes = true })
+}
+
+// WithFlushTracking returns an option that adds a counter of response flushes,
+// which may be used to see which handlers stream responses.
+func WithFlushTracking() Option {
+	return optFunc(func(mw *Middleware) { mw.flushes = true })
+}
+
+// WithUpgradedConnections returns an option that adds a gauge of connections
+// currently upgraded by handlers (e.g. to WebSockets). A connection is counted
+// from when it's hijacked until it's closed.
+func WithUpgradedConnections() Option {
+	return optFunc(func(mw *Middleware) { mw.upgradedConns = true })
+}
+
+// WithResponseSize returns an option that adds a response size histogram.
+func WithResponseSize() Option {
+	return optFunc(func(mw *Middleware) { mw.responseSize = true })
+}
+
+// WithResponseHeaderSize returns an option that adds a histogram of response
+// header sizes, approximated by the lengths of the header names and values.
+func WithResponseHeaderSize() Option {
+	return optFunc(func(mw *Middleware) { mw.headerSize = true })
+}
+
+// WithResponseSizeBuckets returns an option that sets the buckets of the
+// response size histogram. The buckets must be in increasing order.
+// If buckets is empty, sizes from 100B to 10MB are used.
+func WithResponseSizeBuckets(buckets []float64) Option {
+	checkBuckets("response size", buckets)
+	return optFunc(func(mw *Middleware) { mw.responseSizeBuckets = buckets })
+}
+
+// WithRequestSize returns an option that adds a request size histogram.
+// The size is taken from the request's Content-Length. If the length is
+// unknown, the size is the number of bytes of the body read by the handler.
+func WithRequestSize() Option {
+	return optFunc(func(mw *Middleware) { mw.requestSize = true })
+}
+
+// WithRequestBodySize returns an option that adds a histogram of the number
+// of bytes of the request body read by the handler, which may differ from the
+// request's Content-Length if the body is chunked or isn't read entirely.
+func WithRequestBodySize() Option {
+	return optFunc(func(mw *Middleware) { mw.bodySize = true })
+}
+
+// WithQueueTime returns an option that adds a histogram of the time requests
+// wait before they're handled, such as in a bounded worker pool. The given
+// function returns the time the request arrived, or false if it's unknown,
+// in which case nothing is observed. The histogram uses the duration buckets.
+func WithQueueTime(arrival func(*http.Request) (time.Time, bool)) Option {
+	return optFunc(func(mw *Middleware) { mw.queueTime = arrival })
+}
+
+// WithTrailerStatus returns an option that sets a function to read the status
+// of a response from its trailers (e.g. a gRPC status mapped to an HTTP status)
+// after the handler returns. The function is given the response's header map,
+// which holds the trailers. If it reports a status, it's recorded instead of the
+// status written by the handler, even though the status sent to the client is
+// unchanged. It doesn't apply to hijacked connections.
+func WithTrailerStatus(fn func(http.Header) (int, bool)) Option {
+	return optFunc(func(mw *Middleware) { mw.trailerFunc = fn })
+}
+
+// statusClientClosedRequest is the nonstandard status used by nginx
+// when the client closes the connection before the response is written.
+const statusClientClosedRequest = 499
+
+// WithClientClosedCode returns an option that records the status of requests
+// as 499 (Client Closed Request) if their context was canceled (e.g. by the
+// client disconnecting) before the handler wrote anything. Otherwise, they're
+// recorded as 200 (OK), since that's the status implied by writing nothing.
+func WithClientClosedCode() Option {
+	return optFunc(func(mw *Middleware) { mw.clientClosed = true })
+}
+
+// WithMaxInFlight returns an option that limits the number of requests each
+// handler serves at once to n. Requests over the limit aren't served and are
+// responded to with 503 (Service Unavailable). They're counted by a rejected
+// requests counter instead of the requests counter. It panics if n isn't
+// positive.
+//
+// The limit is held by each handler returned by Handler, Wrap, or the like,
+// not by each handler name, so all of the names given to the requests of a
+// handler by WithHandlerName share a single limit.
+func WithMaxInFlight(n int) Option {
+	if n <= 0 || n > math.MaxInt32 {
+		panic(fmt.Sprintf("httpprom: invalid max in-flight requests: %d", n))
+	}
+	return optFunc(func(mw *Middleware) { mw.maxInFlight = n })
+}
+
+// WithPanicRecovery returns an option that adds a counter of handler panics.
+// Panics are re-raised after they're counted.
+func WithPanicRecovery() Option {
+	return optFunc(func(mw *Middleware) { mw.panicRecovery = true })
+}
+
+// WithHandlerName returns an option that derives the handler label from
+// each request with the given function, instead of using the handler's name.
+// It should return a route template, never the raw request path, which
+// clients control. It's called before the handler is served, so a route
+// matched by a router is only available if the router calls the instrumented
+// handler after matching (e.g. with gorilla/mux's Router.Use) instead of being
+// wrapped itself. If WithDeferredName is given, it's called after the handler
+// is served.
+func WithHandlerName(fn func(*http.Request) string) Option {
+	return optFunc(func(mw *Middleware) { mw.nameFunc = fn })
+}
+
+// WithDeferredName returns an option that calls the WithHandlerName function
+// after the handler is served, instead of before. It may be used with routers
+// that resolve the route while serving the request (e.g. chi). Flushes,
+// pushes, handler errors, and panics are recorded once the name is resolved,
+// but the pending requests gauge and the rejected requests, queue time, and
+// upgraded connections metrics are recorded before the request is served, so
+// they use the handler's name. For Wrap, that's the WithDefaultHandlerName
+// name, if given, or "unknown". HandlerNameFromContext reports no name.
+func WithDeferredName() Option {
+	return optFunc(func(mw *Middleware) { mw.deferName = true })
+}
+
+// WithNameContext returns an option that adds the handler name of each request
+// to its context, where it may be retrieved by HandlerNameFromContext. It's not
+// added by default, since deriving the request with the new context allocates.
+func WithNameContext() Option {
+	return optFunc(func(mw *Middleware) { mw.nameContext = true })
+}
+
+// WithSkipPaths returns an option that skips instrumentation of requests
+// whose URL paths exactly match any of the given paths (e.g. health checks).
+func WithSkipPaths(paths ...string) Option {
+	return optFunc(func(mw *Middleware) { mw.skipPaths = append(mw.skipPaths, paths...) })
+}
+
+// WithSkipFunc returns an option that skips instrumentation of requests
+// for which the given function returns true.
+func WithSkipFunc(fn func(*http.Request) bool) Option {
+	return optFunc(func(mw *Middleware) { mw.skipFunc = fn })
+}
+
+// WithExemplarFromContext returns an option that adds exemplars to the
+// request duration histogram. The function is called with each request's
+// context and, if it returns non-nil labels (e.g. a trace ID), they're
+// attached to the observation as an exemplar. Labels that would be rejected by
+// the client, because a name is invalid, a value isn't valid UTF-8, or they
+// exceed prometheus.ExemplarMaxRunes, are dropped.
+func WithExemplarFromContext(fn func(context.Context) prometheus.Labels) Option {
+	return optFunc(func(mw *Middleware) { mw.exemplar = fn })
+}
+
+// WithRegisterer returns an option that registers the metrics with the
+// given registerer when the middleware or mux is created. It panics if
+// registration fails. The Collector must not also be registered with the
+// registerer.
+func WithRegisterer(r prometheus.Registerer) Option {
+	return optFunc(func(mw *Middleware) { mw.registerer = r })
+}
+
+// WithMethodFilter returns an option that limits the values of the method
+// label to the given methods. Any other method is labeled as "other".
+func WithMethodFilter(methods []string) Option {
+	return optFunc(func(mw *Middleware) { mw.methods = methods })
+}
+
+// WithUppercaseMethod returns an option that uses uppercase values
+// (e.g. "GET") for the method label, instead of lowercase values.
+func WithUppercaseMethod() Option {
+	return optFunc(func(mw *Middleware) { mw.upperMethod = true })
+}
+
+// WithNamespace returns an option that adds a namespace to all metrics.
+func WithNamespace(namespace string) Option {
+	return optFunc(func(mw *Middleware) { mw.namespace = namespace })
+}
+
+// WithSubsystem returns an option that adds a subsystem to all metrics.
+// It's placed after the namespace given by WithNamespace, if any.
+func WithSubsystem(subsystem string) Option {
+	return optFunc(func(mw *Middleware) { mw.subsystem = subsystem })
+}
+
+// WithRequestsMetricName returns an option that overrides the name of the
+// requests counter. It panics if the name isn't a valid metric name.
+//
+// Only the names of the requests counter, the pending requests gauge, and the
+// request duration, response size, and request size histograms may be
+// overridden. The other metrics, such as those added by WithHandlerErrors or
+// WithFlushTracking, keep their default names, prefixed by WithNamespace and
+// WithSubsystem.
+func WithRequestsMetricName(name string) Option {
+	return metricNameOpt(requestsName, name)
+}
+
+// WithPendingMetricName returns an option that overrides the name of the
+// pending requests gauge. It panics if the name isn't a valid metric name.
+func WithPendingMetricName(name string) Option {
+	return metricNameOpt(pendingName, name)
+}
+
+// WithDurationMetricName returns an option that overrides the name of the
+// request duration histogram. It panics if the name isn't a valid metric name.
+func WithDurationMetricName(name string) Option {
+	return metricNameOpt(durationName, name)
+}
+
+// WithResponseSizeMetricName returns an option that overrides the name of the
+// response size histogram. It panics if the name isn't a valid metric name.
+func WithResponseSizeMetricName(name string) Option {
+	return metricNameOpt(responseSizeName, name)
+}
+
+// WithRequestSizeMetricName returns an option that overrides the name of the
+// request size histogram. It panics if the name isn't a valid metric name.
+func WithRequestSizeMetricName(name string) Option {
+	return metricNameOpt(requestSizeName, name)
+}
+
+func metricNameOpt(metric, name string) Option {
+	if !metricNameRE.MatchString(name) {
+		panic(fmt.Sprintf("httpprom: invalid metric name: %q", name))
+	}
+	return optFunc(func(mw *Middleware) {
+		if mw.metricNames == nil {
+			mw.metricNames = make(map[string]string)
+		}
+		mw.metricNames[metric] = name
+	})
+}
+
+// WithRequestsHelp returns an option that overrides the help text of the
+// requests counter. It panics if the help text is empty.
+//
+// Help text overrides are limited to the same five metrics as name overrides
+// (see WithRequestsMetricName); the other metrics always use their default
+// help text.
+func WithRequestsHelp(help string) Option {
+	return metricHelpOpt(requestsName, help)
+}
+
+// WithPendingHelp returns an option that overrides the help text of the
+// pending requests gauge. It panics if the help text is empty.
+func WithPendingHelp(help string) Option {
+	return metricHelpOpt(pendingName, help)
+}
+
+// WithDurationHelp returns an option that overrides the help text of the
+// request duration histogram. It panics if the help text is empty.
+func WithDurationHelp(help string) Option {
+	return metricHelpOpt(durationName, help)
+}
+
+// WithResponseSizeHelp returns an option that overrides the help text of the
+// response size histogram. It panics if the help text is empty.
+func WithResponseSizeHelp(help string) Option {
+	return metricHelpOpt(responseSizeName, help)
+}
+
+// WithRequestSizeHelp returns an option that overrides the help text of the
+// request size histogram. It panics if the help text is empty.
+func WithRequestSizeHelp(help string) Option {
+	return metricHelpOpt(requestSizeName, help)
+}
+
+func metricHelpOpt(metric, help string) Option {
+	if help == "" {
+		panic("httpprom: empty metric help")
+	}
+	return optFunc(func(mw *Middleware) {
+		if mw.metricHelps == nil {
+			mw.metricHelps = make(map[string]string)
+		}
+		mw.metricHelps[metric] = help
+	})
+}
+
+// WithCounterLabels returns an option that selects whether the handler,
+// method, and code labels are added to the requests counter, overriding
+// WithoutHandlerLabel, WithMethod, and WithCode.
+func WithCounterLabels(handler, method, code bool) Option {
+	return metricLabelsOpt(requestsName, labelFlags{handler: handler, method: method, code: code})
+}
+
+// WithPendingLabels returns an option that selects whether the handler and
+// method labels are added to the pending requests gauge, overriding
+// WithoutHandlerLabel and WithMethod.
+func WithPendingLabels(handler, method bool) Option {
+	return metricLabelsOpt(pendingName, labelFlags{handler: handler, method: method})
+}
+
+// WithDurationLabels returns an option that selects whether the handler,
+// method, and code labels are added to the duration histogram, overriding
+// WithoutHandlerLabel, WithMethod, and WithCode. For example, slow errors may
+// be distinguished by code without adding the code label to the counter.
+func WithDurationLabels(handler, method, code bool) Option {
+	return metricLabelsOpt(durationName, labelFlags{handler: handler, method: method, code: code})
+}
+
+// WithResponseSizeLabels returns an option that selects whether the handler,
+// method, and code labels are added to the response size histogram,
+// overriding WithoutHandlerLabel, WithMethod, and WithCode. For example, large
+// 200 (OK) payloads may be distinguished from small error bodies by code
+// without adding the code label to the counter.
+func WithResponseSizeLabels(handler, method, code bool) Option {
+	return metricLabelsOpt(responseSizeName, labelFlags{handler: handler, method: method, code: code})
+}
+
+// WithRequestSizeLabels returns an option that selects whether the handler,
+// method, and code labels are added to the request size histogram,
+// overriding WithoutHandlerLabel, WithMethod, and WithCode.
+func WithRequestSizeLabels(handler, method, code bool) Option {
+	return metricLabelsOpt(requestSizeName, labelFlags{handler: handler, method: method, code: code})
+}
+
+func metricLabelsOpt(metric string, flags labelFlags) Option {
+	return optFunc(func(mw *Middleware) {
+		if mw.metricLabels == nil {
+			mw.metricLabels = make(map[string]labelFlags)
+		}
+		mw.metricLabels[metric] = flags
+	})
+}
+
+// WithConstLabels returns an option that adds constant labels to all metrics.
+// Metrics with the same fully-qualified name must have the same label names in
+// their ConstLabels. It panics if a label's name is reserved for a variable
+// label: "handler", "method", or "code". Creating the middleware panics if a
+// label's name is the name of any other variable label that's enabled, such as
+// "host" or a label given by WithHeaderLabel.
+func WithConstLabels(labels prometheus.Labels) Option {
+	for name := range labels {
+		switch name {
+		case "handler", "method", "code":
+			panic(fmt.Sprintf("httpprom: const label name %q is reserved", name))
+		}
+	}
+	return optFunc(func(mw *Middleware) { mw.constLabels = labels })
+}
+
+// A HandlerOption changes the default behavior of a handler.
+type HandlerOption interface {
+	applyHandlerOpt(*handlerConfig)
+}
+
+type handlerOptFunc func(*handlerConfig)
+
+func (fn handlerOptFunc) applyHandlerOpt(c *handlerConfig) { fn(c) }
+
+// WithName returns a handler option that sets the name of the handler.
+// The default value is the handler pattern or name. It takes precedence
+// over any function given by WithHandlerName.
+func WithName(name string) HandlerOption {
+	return handlerOptFunc(func(c *handlerConfig) {
+		c.name = name
+		c.nameFunc = nil
+	})
+}
+
+// WithHandlerConstLabels returns a handler option that overrides the values
+// of constant labels given by WithConstLabels for the handler's metrics.
+// Since metrics with the same fully-qualified name must have the same label
+// names, each label must also be given by WithConstLabels or creating the
+// handler panics. Each distinct set of values creates a new set of metrics,
+// so the values should be fixed per handler (e.g. its team or tier) rather
+// than vary with requests or deployments. Handlers should be
+// created before the middleware's Collector is registered, unless it's
+// registered with WithRegisterer, Register, or MustRegister.
+func WithHandlerConstLabels(labels prometheus.Labels) HandlerOption {
+	return handlerOptFunc(func(c *handlerConfig) { c.constLabels = labels })
+}
+
+// WithDisabledMetrics returns a handler option that disables the handler's
+// metrics, so that its requests are served without being recorded by any
+// metric. It may be used for noisy handlers, such as health checks, that
+// are registered to a ServeMux for routing.
+func WithDisabledMetrics() HandlerOption {
+	return handlerOptFunc(func(c *handlerConfig) { c.disabled = true })
+}
+
+type pendingLabelsFunc func(handler, method string) []string
+type labelsFunc func(r *http.Request, handler, method string, code int, header http.Header) []string
+type updateFunc func(labelValues []string)
+type observeFunc func(labelValues []string, value float64, exemplar prometheus.Labels)
+type hijackFunc func(labelValues []string, conn net.Conn) net.Conn
+
+type handlerConfig struct {
+	name           string
+	pattern        string
+	nameFunc       func(*http.Request) string
+	deferName      bool
+	nameContext    bool
+	disabled       bool
+	skip           func(*http.Request) bool
+	constLabels    prometheus.Labels
+	handler        http.Handler
+	now            func() time.Time
+	lookupMethod   func(string) string
+	exemplar       func(context.Context) prometheus.Labels
+	queueTime      func(*http.Request) (time.Time, bool)
+	untilFlush     bool
+	trailerStatus  func(http.Header) (int, bool)
+	sampleRate     float64
+	random         func() float64
+	clientClosed   bool
+	durationUnit   time.Duration
+	pendingLabels  pendingLabelsFunc
+	pendingGauge   pendingLabelsFunc
+	inFlightBefore updateFunc
+	inFlightDefer  updateFunc
+	pendingBefore  updateFunc
+	pendingDefer   updateFunc
+	queueBefore    observeFunc
+	rejectBefore   updateFunc
+	panicRecover   updateFunc
+	errorAfter     updateFunc
+	emptyAfter     updateFunc
+	writeErrAfter  updateFunc
+	hijack         hijackFunc
+	flush          updateFunc
+	push           updateFunc
+	pushFail       updateFunc
+	obs            *observerValue
+
+	active    int32 // NB: accessed atomically
+	maxActive int32
+
+	// NB: if the handler's labels are static, its children are cached
+	pendingStatic []string
+	static        []string
+	staticObs     *observers
+	pendingChild  prometheus.Gauge
+	requestChild  prometheus.Counter
+}
+
+// observers update the metrics with request labels. They're replaced
+// together by SetCodeEnabled, since their label names may change.
+type observers struct {
+	requestLabels     labelsFunc
+	defaultLabels     labelIndexes
+	counterLabels     labelIndexes
+	durationLabels    labelIndexes
+	respSizeLabels    labelIndexes
+	reqSizeLabels     labelIndexes
+	requestAfter      updateFunc
+	durationAfter     observeFunc
+	summaryAfter      observeFunc
+	ttfbAfter         observeFunc
+	responseSizeAfter observeFunc
+	headerSizeAfter   observeFunc
+	requestSizeAfter  observeFunc
+	bodySizeAfter     observeFunc
+}
+
+// observerValue holds observers, which are loaded and stored atomically.
+type observerValue struct{ v atomic.Value }
+
+func (o *observerValue) load() *observers     { return o.v.Load().(*observers) }
+func (o *observerValue) store(obs *observers) { o.v.Store(obs) }
+
+func (h *handlerConfig) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.disabled || h.skip != nil && h.skip(r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	o := h.obs.load() // NB: the request uses the same observers throughout
+	if h.inFlightBefore != nil {
+		h.inFlightBefore(nil)
+		defer h.inFlightDefer(nil)
+	}
+	name := h.name
+	if h.nameFunc != nil && !h.deferName {
+		name = h.nameFunc(r)
+	}
+	if h.nameContext && !h.deferName {
+		r = r.WithContext(context.WithValue(r.Context(), handlerNameKey{}, name))
+	}
+	method := h.lookupMethod(r.Method)
+	plvs := h.pendingStatic
+	if plvs == nil {
+		plvs = h.pendingLabels(name, method)
+	}
+	if h.maxActive > 0 {
+		defer atomic.AddInt32(&h.active, -1)
+		if atomic.AddInt32(&h.active, 1) > h.maxActive {
+			h.rejectBefore(plvs) // NB: rejected requests aren't pending or completed
+			code := http.StatusServiceUnavailable
+			http.Error(w, http.StatusText(code), code)
+			return
+		}
+	}
+	if h.pendingChild != nil && o == h.staticObs {
+		h.pendingChild.Inc()
+		defer h.pendingChild.Dec()
+	} else if h.pendingBefore != nil {
+		glvs := plvs
+		if h.pendingGauge != nil {
+			glvs = h.pendingGauge(name, method)
+		}
+		h.pendingBefore(glvs)
+		defer h.pendingDefer(glvs)
+	}
+	if h.queueBefore != nil {
+		if arrival, ok := h.queueTime(r); ok {
+			wait := h.now().Sub(arrival)
+			if wait < 0 {
+				wait = 0 // NB: clocks may be skewed
+			}
+			h.queueBefore(plvs, wait.Seconds(), nil)
+		}
+	}
+
+	var body *countingReader
+	size := r.ContentLength
+	if (o.bodySizeAfter != nil || o.requestSizeAfter != nil && size < 0) && r.Body != nil {
+		orig := r.Body
+		body = &countingReader{ReadCloser: orig}
+		r.Body = body
+		defer func() { r.Body = orig }()
+	}
+
+	var now func() time.Time
+	if o.ttfbAfter != nil || h.untilFlush {
+		now = h.now
+	}
+	var onHijack func(net.Conn) net.Conn
+	if h.hijack != nil {
+		onHijack = func(conn net.Conn) net.Conn { return h.hijack(plvs, conn) }
+	}
+	var counts *deferredCounts
+	if h.deferName && h.nameFunc != nil {
+		counts = &deferredCounts{} // NB: recorded once the name is resolved
+	}
+	var onFlush func()
+	if h.flush != nil {
+		onFlush = func() {
+			if counts != nil {
+				counts.flushes++
+				return
+			}
+			h.flush(plvs)
+		}
+	}
+	var onPush func(error)
+	if h.push != nil {
+		onPush = func(err error) {
+			if counts != nil {
+				counts.pushes++
+				if err != nil {
+					counts.pushFailures++
+				}
+				return
+			}
+			h.push(plvs)
+			if err != nil {
+				h.pushFail(plvs)
+			}
+		}
+	}
+	d := promhttp.NewDelegator(w, now, onHijack, onFlush, onPush)
+	defer promhttp.ReleaseDelegator(d) // NB: deferred first, so it's released after it's observed
+	start := h.now()
+	if h.panicRecover != nil {
+		defer func() {
+			if err := recover(); err != nil {
+				name, plvs := h.resolveName(r, name, method, plvs, counts)
+				h.panicRecover(plvs)
+				code := h.status(r, d)
+				if !d.WroteHeader() && !d.Hijacked() {
+					code = http.StatusInternalServerError
+				}
+				h.observe(o, r, d, name, method, code, start, size, body)
+				panic(err)
+			}
+		}()
+	}
+	failed := h.serve(d, r)
+	name, plvs = h.resolveName(r, name, method, plvs, counts)
+	if failed && h.errorAfter != nil {
+		h.errorAfter(plvs)
+	}
+	h.observe(o, r, d, name, method, h.status(r, d), start, size, body)
+}
+
+// deferredCounts are the counts of a request with a deferred name that are
+// recorded after it's served.
+type deferredCounts struct {
+	flushes      int
+	pushes       int
+	pushFailures int
+}
+
+// resolveName returns the name of the handler after it's served and its
+// pending label values, and records the deferred counts with them.
+func (h *handlerConfig) resolveName(r *http.Request, name, method string, plvs []string, counts *deferredCounts) (string, []string) {
+	if counts == nil {
+		return name, plvs
+	}
+	name = h.nameFunc(r)
+	plvs = h.pendingLabels(name, method)
+	for i := 0; i < counts.flushes; i++ {
+		h.flush(plvs)
+	}
+	for i := 0; i < counts.pushes; i++ {
+		h.push(plvs)
+	}
+	for i := 0; i < counts.pushFailures; i++ {
+		h.pushFail(plvs)
+	}
+	return name, plvs
+}
+
+// serve serves the request and reports whether its ErrorHandlerFunc failed.
+func (h *handlerConfig) serve(d promhttp.Delegator, r *http.Request) bool {
+	fn, ok := h.handler.(ErrorHandlerFunc)
+	if !ok {
+		h.handler.ServeHTTP(d, r)
+		return false
+	}
+	return fn.serve(d, r) != nil
+}
+
+type handlerNameKey struct{}
+
+// HandlerNameFromContext returns the handler name of the request with the
+// given context, which is the value of its handler label (even if the label
+// is removed by WithoutHandlerLabel). It may be used to correlate logs with
+// metrics. It reports no name unless WithNameContext is given.
+func HandlerNameFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(handlerNameKey{}).(string)
+	return name, ok
+}
+
+// status returns the response status code recorded by the delegator.
+// Hijacked connections are reported as 101 (Switching Protocols),
+// since the handler takes over the connection to upgrade the protocol
+// and the real status can't be observed. Hijacked CONNECT requests are
+// reported as 200 (OK), since the handler takes over the connection to
+// establish a tunnel. If a trailer status function is given by
+// WithTrailerStatus and it reports a status, it takes precedence over the
+// recorded status of a connection that isn't hijacked. If WithClientClosedCode
+// is given and the request's context was canceled before anything was written,
+// it's reported as 499 (Client Closed Request) instead of an implicit 200 (OK).
+func (h *handlerConfig) status(r *http.Request, d promhttp.Delegator) int {
+	if d.Hijacked() {
+		if r.Method == http.MethodConnect {
+			return http.StatusOK
+		}
+		return http.StatusSwitchingProtocols
+	}
+	if h.clientClosed && !d.WroteHeader() && r.Context().Err() == context.Canceled {
+		return statusClientClosedRequest
+	}
+	if h.trailerStatus != nil {
+		if code, ok := h.trailerStatus(d.Header()); ok {
+			return code
+		}
+	}
+	return d.Status()
+}
+
+func (h *handlerConfig) observe(o *observers, r *http.Request, d promhttp.Delegator, name, method string, code int, start time.Time, size int64, body *countingReader) {
+	elapsed := h.now().Sub(start)
+	var all, lvs []string // NB: all has the labels of every metric, if they differ
+	if o == h.staticObs && h.static != nil {
+		lvs = h.static
+	} else {
+		all = o.requestLabels(r, name, method, code, d.Header())
+		lvs = o.defaultLabels.values(all)
+	}
+	if o == h.staticObs && h.requestChild != nil {
+		h.requestChild.Inc()
+	} else {
+		o.requestAfter(o.counterLabels.valuesOr(all, lvs))
+	}
+	if h.emptyAfter != nil && code == http.StatusOK && d.Written() == 0 && r.Method != http.MethodHead && !d.Hijacked() {
+		h.emptyAfter(h.pendingLabels(name, method))
+	}
+	if h.writeErrAfter != nil && d.Err() != nil {
+		h.writeErrAfter(h.pendingLabels(name, method))
+	}
+	duration := elapsed
+	if t := d.FlushedAt(); h.untilFlush && !t.IsZero() {
+		duration = t.Sub(start)
+	}
+	sampled := h.sampleRate == 0 || h.random() < h.sampleRate
+	if o.durationAfter != nil && sampled {
+		var exemplar prometheus.Labels
+		if h.exemplar != nil {
+			exemplar = h.exemplar(r.Context())
+		}
+		o.durationAfter(o.durationLabels.valuesOr(all, lvs), inUnit(duration, h.durationUnit), exemplar)
+	}
+	if o.summaryAfter != nil && sampled {
+		o.summaryAfter(lvs, inUnit(duration, h.durationUnit), nil)
+	}
+	if o.ttfbAfter != nil {
+		ttfb := elapsed // NB: if nothing was written, the header is written after the handler returns
+		if t := d.WroteHeaderAt(); !t.IsZero() {
+			ttfb = t.Sub(start)
+		}
+		o.ttfbAfter(lvs, ttfb.Seconds(), nil)
+	}
+	if o.responseSizeAfter != nil {
+		o.responseSizeAfter(o.respSizeLabels.valuesOr(all, lvs), float64(d.Written()), nil)
+	}
+	if o.headerSizeAfter != nil && !d.Hijacked() {
+		o.headerSizeAfter(lvs, float64(headerSize(d.Header())), nil)
+	}
+	if o.requestSizeAfter != nil {
+		o.requestSizeAfter(o.reqSizeLabels.valuesOr(all, lvs), float64(bodySize(size, body)), nil)
+	}
+	if o.bodySizeAfter != nil {
+		o.bodySizeAfter(lvs, float64(bodyRead(body)), nil)
+	}
+}
+
+// labelIndexes are the indexes of a metric's label values
+// in the values of all of the request labels.
+type labelIndexes []int
+
+// values returns the metric's label values, or all of them if x is nil.
+func (x labelIndexes) values(all []string) []string {
+	if x == nil {
+		return all
+	}
+	lvs := make([]string, len(x))
+	for i, j := range x {
+		lvs[i] = all[j]
+	}
+	return lvs
+}
+
+// valuesOr returns the metric's label values, or lvs if x is nil.
+func (x labelIndexes) valuesOr(all, lvs []string) []string {
+	if x == nil {
+		return lvs
+	}
+	return x.values(all)
+}
+
+// Middleware wraps handlers with prometheus instrumentation.
+//
+// The http.ResponseWriter given to an instrumented handler is pooled and
+// reused by other requests once the handler returns. As with any
+// ResponseWriter, it must not be used after that (e.g. by a goroutine started
+// by the handler to write or flush late), or it may panic or write to another
+// request's response.
+type Middleware struct {
+	now    func() time.Time
+	random func() float64
+
+	mu          sync.Mutex
+	cs          collectors
+	names       map[string]bool // fully-qualified
+	registerers []prometheus.Registerer
+	children    map[string]*metrics // by const label values
+
+	metrics
+	inFlight     *prometheus.GaugeVec   // NB: shared by all handlers
+	serverErrors *prometheus.CounterVec // NB: shared by all handlers
+
+	namespace    string
+	metricNames  map[string]string     // by default name
+	metricHelps  map[string]string     // by default name
+	metricLabels map[string]labelFlags // by default name
+	subsystem    string
+	constLabels  prometheus.Labels
+	nameFunc     func(*http.Request) string
+	deferName    bool
+	nameContext  bool
+	defaultName  string
+	skipPaths    []string
+	skipFunc     func(*http.Request) bool
+	exemplar     func(context.Context) prometheus.Labels
+	registerer   prometheus.Registerer
+	methods      []string
+	upperMethod  bool
+	method       bool
+	code         bool
+	codeMapper   func(int) string
+	codeClass    bool
+	noPending    bool
+	noHandler    bool
+	notFound     bool
+	patternName  bool
+	pathDepth    int
+	host         bool
+	hostFilter   func(string) string
+	maxLabelLen  int
+	scheme       bool
+	proto        bool
+	traceFunc    func(context.Context) string
+	outcome      bool
+	cancellation bool
+	contentTypes []string
+	reqContent   bool
+	respContent  bool
+	custom       []customLabel
+	duration     bool
+	ttfb         bool
+	untilFlush   bool
+	maxInFlight  int
+	trailerFunc  func(http.Header) (int, bool)
+	clientClosed bool
+	responseSize bool
+	headerSize   bool
+	requestSize  bool
+	bodySize     bool
+	queueTime    func(*http.Request) (time.Time, bool)
+
+	panicRecovery  bool
+	globalInFlight bool
+	serverErrs     bool
+	infos          []infoMetric
+	handlerErrors  bool
+	emptyResponses bool
+	writeErrs      bool
+	upgradedConns  bool
+	flushes        bool
+	pushes         bool
+
+	durationUnit       time.Duration
+	sampleRate         float64
+	durationSummary    bool
+	durationObjectives map[float64]float64
+
+	durationBuckets     []float64
+	responseSizeBuckets []float64
+}
+
+// metrics are the metric vectors of a middleware
+// or of its handlers with the same const labels.
+type metrics struct {
+	constLabels prometheus.Labels
+	obs         *observerValue
+
+	requests      *prometheus.CounterVec
+	pending       *prometheus.GaugeVec
+	durations     *prometheus.HistogramVec
+	summaries     *prometheus.SummaryVec
+	ttfbs         *prometheus.HistogramVec
+	responseSizes *prometheus.HistogramVec
+	headerSizes   *prometheus.HistogramVec
+	requestSizes  *prometheus.HistogramVec
+	bodySizes     *prometheus.HistogramVec
+	queues        *prometheus.HistogramVec
+	rejects       *prometheus.CounterVec
+	panics        *prometheus.CounterVec
+	errors        *prometheus.CounterVec
+	empties       *prometheus.CounterVec
+	writeErrs     *prometheus.CounterVec
+	upgraded      *prometheus.GaugeVec
+	flushes       *prometheus.CounterVec
+	pushes        *prometheus.CounterVec
+	pushFailures  *prometheus.CounterVec
+}
+
+// infoMetric is a gauge whose value is always 1.
+type infoMetric struct {
+	name   string
+	labels prometheus.Labels
+}
+
+// replaceRequestVecs replaces the vectors with request labels by those of
+// fresh. It returns the replaced and replacing vectors.
+func (m *metrics) replaceRequestVecs(fresh *metrics) (olds, news collectors) {
+	replace := func(old, new prometheus.Collector) {
+		olds = append(olds, old)
+		news = append(news, new)
+	}
+	replace(m.requests, fresh.requests)
+	m.requests = fresh.requests
+	if m.durations != nil {
+		replace(m.durations, fresh.durations)
+		m.durations = fresh.durations
+	}
+	if m.summaries != nil {
+		replace(m.summaries, fresh.summaries)
+		m.summaries = fresh.summaries
+	}
+	if m.ttfbs != nil {
+		replace(m.ttfbs, fresh.ttfbs)
+		m.ttfbs = fresh.ttfbs
+	}
+	if m.responseSizes != nil {
+		replace(m.responseSizes, fresh.responseSizes)
+		m.responseSizes = fresh.responseSizes
+	}
+	if m.headerSizes != nil {
+		replace(m.headerSizes, fresh.headerSizes)
+		m.headerSizes = fresh.headerSizes
+	}
+	if m.requestSizes != nil {
+		replace(m.requestSizes, fresh.requestSizes)
+		m.requestSizes = fresh.requestSizes
+	}
+	if m.bodySizes != nil {
+		replace(m.bodySizes, fresh.bodySizes)
+		m.bodySizes = fresh.bodySizes
+	}
+	return olds, news
+}
+
+// NewMiddleware returns a new middleware with the given options.
+func NewMiddleware(options ...Option) *Middleware {
+	mw := &Middleware{now: time.Now, random: randomFloat64}
+	for _, opt := range options {
+		opt.applyOpt(mw)
+	}
+	mw.checkLabelNames()
+	mw.metrics = mw.newMetrics(mw.constLabels)
+	mw.children = map[string]*metrics{labelsKey(mw.constLabels): &mw.metrics}
+	if mw.globalInFlight {
+		mw.inFlight = mw.newGaugeVec(prometheus.GaugeOpts{
+			Name:        "http_server_in_flight_requests",
+			Help:        "Number of HTTP server requests currently in flight.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: mw.constLabels,
+		}, nil)
+	}
+	if mw.serverErrs {
+		mw.serverErrors = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_errors_total",
+			Help:        "Total number of errors logged by the HTTP server.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: mw.constLabels,
+		}, []string{"kind"})
+	}
+	for _, info := range mw.infos {
+		mw.cs = append(mw.cs, prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        info.name,
+			Help:        "Information about the HTTP server.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: mergeLabels(mw.constLabels, info.labels),
+		}, func() float64 { return 1 }))
+		mw.addName(mw.namespace, mw.subsystem, info.name)
+	}
+	if mw.registerer != nil {
+		mw.MustRegister(mw.registerer)
+	}
+	return mw
+}
+
+// checkLabelNames panics if any variable label names are duplicated or are also
+// const label names, which would otherwise panic with a less clear error when
+// the metrics are created.
+func (mw *Middleware) checkLabelNames() {
+	names := labelNames(mw.requestLabelsWith(labelFlags{handler: true, method: true, code: true}))
+	if mw.serverErrs {
+		names = append(names, "kind")
+	}
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		if seen[name] {
+			panic(fmt.Sprintf("httpprom: duplicate variable label name: %q", name))
+		}
+		seen[name] = true
+		if _, ok := mw.constLabels[name]; ok {
+			panic(fmt.Sprintf("httpprom: const label name %q is also a variable label name", name))
+		}
+	}
+}
+
+// Default metric names.
+const (
+	requestsName     = "http_server_requests_total"
+	pendingName      = "http_server_requests_pending"
+	durationName     = "http_server_request_duration_seconds"
+	responseSizeName = "http_server_response_size_bytes"
+	requestSizeName  = "http_server_request_size_bytes"
+)
+
+// metricNameRE matches valid prometheus metric names.
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// labelNameRE matches valid prometheus label names.
+var labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// metricName returns the name of the metric with the given default name.
+func (mw *Middleware) metricName(name string) string {
+	if s, ok := mw.metricNames[name]; ok {
+		return s
+	}
+	return name
+}
+
+// metricHelp returns the help text of the metric with the given default name,
+// or the given default help text.
+func (mw *Middleware) metricHelp(name, help string) string {
+	if s, ok := mw.metricHelps[name]; ok {
+		return s
+	}
+	return help
+}
+
+// newMetrics returns new metric vectors with the given const labels.
+func (mw *Middleware) newMetrics(constLabels prometheus.Labels) metrics {
+	m := metrics{constLabels: constLabels, obs: new(observerValue)}
+	m.requests = mw.newCounterVec(prometheus.CounterOpts{
+		Name:        mw.metricName(requestsName),
+		Help:        mw.metricHelp(requestsName, "Total number of HTTP server requests completed."),
+		Namespace:   mw.namespace,
+		Subsystem:   mw.subsystem,
+		ConstLabels: constLabels,
+	}, mw.metricLabelNames(requestsName))
+	if !mw.noPending {
+		m.pending = mw.newGaugeVec(prometheus.GaugeOpts{
+			Name:        mw.metricName(pendingName),
+			Help:        mw.metricHelp(pendingName, "Number of HTTP server requests currently pending."),
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.metricLabelNames(pendingName))
+	}
+	if mw.duration {
+		name := mw.unitName(durationName)
+		if s, ok := mw.metricNames[durationName]; ok {
+			name = s
+		}
+		m.durations = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        name,
+			Help:        mw.metricHelp(durationName, "Histogram of HTTP server request durations in "+mw.unitHelp()+"."),
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     mw.durationBucketsIn(mw.unit()),
+		}, mw.metricLabelNames(durationName))
+	}
+	if mw.durationSummary {
+		m.summaries = mw.newSummaryVec(prometheus.SummaryOpts{
+			Name:        mw.unitName("http_server_request_duration_summary_seconds"),
+			Help:        "Summary of HTTP server request durations in " + mw.unitHelp() + ".",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Objectives:  mw.durationObjectives,
+		}, mw.requestLabelNames())
+	}
+	if mw.ttfb {
+		m.ttfbs = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        "http_server_request_ttfb_seconds",
+			Help:        "Histogram of HTTP server request times to first byte in seconds.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     prometheus.DefBuckets,
+		}, mw.requestLabelNames())
+	}
+	if mw.responseSize {
+		m.responseSizes = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        mw.metricName(responseSizeName),
+			Help:        mw.metricHelp(responseSizeName, "Histogram of HTTP server response sizes in bytes."),
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     orDefault(mw.responseSizeBuckets, sizeBuckets),
+		}, mw.metricLabelNames(responseSizeName))
+	}
+	if mw.headerSize {
+		m.headerSizes = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        "http_server_response_header_bytes",
+			Help:        "Histogram of HTTP server response header sizes in bytes, approximated by the lengths of header names and values without HTTP framing.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     headerSizeBuckets,
+		}, mw.requestLabelNames())
+	}
+	if mw.requestSize {
+		m.requestSizes = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        mw.metricName(requestSizeName),
+			Help:        mw.metricHelp(requestSizeName, "Histogram of HTTP server request sizes in bytes."),
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     sizeBuckets,
+		}, mw.metricLabelNames(requestSizeName))
+	}
+	if mw.bodySize {
+		m.bodySizes = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        "http_server_request_body_bytes",
+			Help:        "Histogram of HTTP server request body bytes read by handlers.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     sizeBuckets,
+		}, mw.requestLabelNames())
+	}
+	if mw.queueTime != nil {
+		m.queues = mw.newHistogramVec(prometheus.HistogramOpts{
+			Name:        "http_server_request_queue_seconds",
+			Help:        "Histogram of HTTP server request queue latencies in seconds.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+			Buckets:     mw.durationBucketsIn(time.Second),
+		}, mw.pendingLabelNames())
+	}
+	if mw.maxInFlight > 0 {
+		m.rejects = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_requests_rejected_total",
+			Help:        "Total number of HTTP server requests rejected by the in-flight limit.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.panicRecovery {
+		m.panics = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_panics_total",
+			Help:        "Total number of HTTP server handler panics.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.handlerErrors {
+		m.errors = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_handler_errors_total",
+			Help:        "Total number of errors returned by HTTP server handlers.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.emptyResponses {
+		m.empties = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_empty_responses_total",
+			Help:        "Total number of HTTP server responses with a 200 status and an empty body.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.writeErrs {
+		m.writeErrs = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_response_write_errors_total",
+			Help:        "Total number of HTTP server responses with write errors.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.flushes {
+		m.flushes = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_response_flushes_total",
+			Help:        "Total number of HTTP server response flushes.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.pushes {
+		m.pushes = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_pushes_total",
+			Help:        "Total number of HTTP/2 server pushes attempted.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+		m.pushFailures = mw.newCounterVec(prometheus.CounterOpts{
+			Name:        "http_server_push_failures_total",
+			Help:        "Total number of HTTP/2 server pushes that failed.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	if mw.upgradedConns {
+		m.upgraded = mw.newGaugeVec(prometheus.GaugeOpts{
+			Name:        "http_server_connections_upgraded",
+			Help:        "Number of HTTP server connections currently upgraded.",
+			Namespace:   mw.namespace,
+			Subsystem:   mw.subsystem,
+			ConstLabels: constLabels,
+		}, mw.pendingLabelNames())
+	}
+	m.obs.store(mw.observersFor(&m))
+	return m
+}
+
+// Collector returns a prometheus collector for the middleware's metrics.
+func (mw *Middleware) Collector() prometheus.Collector {
+	return collector{mw}
+}
+
+// MetricNames returns the sorted fully-qualified names of the middleware's
+// metrics, as described by its Collector. Histograms and summaries are named
+// without the suffixes of their series (e.g. "_bucket").
+func (mw *Middleware) MetricNames() []string {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	names := make([]string, 0, len(mw.names))
+	for name := range mw.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// RequestsCounter returns the requests counter. It may be registered or
+// used individually, but not in addition to the middleware's Collector in
+// the same registry. It doesn't include the metrics of handlers created
+// with WithHandlerConstLabels.
+func (mw *Middleware) RequestsCounter() *prometheus.CounterVec {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.requests
+}
+
+// PendingGauge returns the pending requests gauge, or nil if it's removed
+// by WithoutPending. The same caveats apply as for RequestsCounter.
+func (mw *Middleware) PendingGauge() *prometheus.GaugeVec {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.pending
+}
+
+// DurationHistogram returns the request duration histogram, or nil if it
+// isn't added by WithDuration. The same caveats apply as for RequestsCounter.
+func (mw *Middleware) DurationHistogram() *prometheus.HistogramVec {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.durations
+}
+
+// ResponseSizeHistogram returns the response size histogram, or nil if it
+// isn't added by WithResponseSize. The same caveats apply as for
+// RequestsCounter.
+func (mw *Middleware) ResponseSizeHistogram() *prometheus.HistogramVec {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.responseSizes
+}
+
+// RequestSizeHistogram returns the request size histogram, or nil if it
+// isn't added by WithRequestSize. The same caveats apply as for
+// RequestsCounter.
+func (mw *Middleware) RequestSizeHistogram() *prometheus.HistogramVec {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return mw.requestSizes
+}
+
+// SetCodeEnabled adds or removes the code label at runtime (e.g. by a feature
+// flag), as if WithCode were given or not. It's safe for concurrent use.
+//
+// Since the label names of a vector can't change, the vectors with the code
+// label are replaced by new ones, starting from zero. If the middleware's
+// metrics are registered with registerers by Register, MustRegister, or
+// WithRegisterer, the replacing vectors are registered with them before the
+// replaced vectors are unregistered. If any registration fails, the change is
+// abandoned and the error is returned. A prometheus.Registry requires the label
+// names of a metric to be consistent for the lifetime of the program, so it
+// always fails; the middleware's Collector should be registered with it instead.
+//
+// Requests pending during the change update the vectors with which they
+// started, so their label values always match the label names. Scrapes
+// collect either the replaced or replacing vectors, but not both. Metrics
+// without the code label, such as the pending requests gauge, are unchanged.
+func (mw *Middleware) SetCodeEnabled(enabled bool) error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if mw.code == enabled {
+		return nil
+	}
+	type change struct {
+		m          *metrics
+		fresh      metrics
+		olds, news collectors
+	}
+	mw.code = enabled
+	n := len(mw.cs)
+	changes := make([]change, 0, len(mw.children))
+	for _, m := range mw.children {
+		c := change{m: m, fresh: mw.newMetrics(m.constLabels)}
+		preview := *m
+		c.olds, c.news = preview.replaceRequestVecs(&c.fresh)
+		changes = append(changes, c)
+	}
+	mw.cs = mw.cs[:n] // NB: vectors without request labels are kept
+
+	type registration struct {
+		r prometheus.Registerer
+		c prometheus.Collector
+	}
+	var done []registration
+	for _, c := range changes {
+		for _, new := range c.news {
+			for _, r := range mw.registerers {
+				if err := r.Register(new); err != nil {
+					for _, d := range done {
+						d.r.Unregister(d.c)
+					}
+					mw.code = !enabled
+					return err
+				}
+				done = append(done, registration{r, new})
+			}
+		}
+	}
+	for _, c := range changes {
+		for i, old := range c.olds {
+			mw.cs.replace(old, c.news[i])
+			for _, r := range mw.registerers {
+				r.Unregister(old)
+			}
+		}
+		c.m.replaceRequestVecs(&c.fresh)
+		c.m.obs.store(mw.observersFor(c.m))
+	}
+	return nil
+}
+
+// Register registers the middleware's metrics with the given registerer.
+// It returns the first error encountered. Metrics of handlers created later
+// with WithHandlerConstLabels are also registered with the registerer.
+func (mw *Middleware) Register(r prometheus.Registerer) error {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	for _, c := range mw.cs {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	mw.registerers = append(mw.registerers, r)
+	return nil
+}
+
+// MustRegister registers the middleware's metrics with the given registerer.
+// It panics if any error occurs. Metrics of handlers created later with
+// WithHandlerConstLabels are also registered with the registerer.
+func (mw *Middleware) MustRegister(r prometheus.Registerer) {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	r.MustRegister(mw.cs...)
+	mw.registerers = append(mw.registerers, r)
+}
+
+// Reset deletes all of the middleware's metrics. It's intended for tests,
+// since resetting while requests are pending leaves pending counts negative.
+func (mw *Middleware) Reset() {
+	for _, c := range mw.collectors() {
+		if v, ok := c.(interface{ Reset() }); ok {
+			v.Reset()
+		}
+	}
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	for _, m := range mw.children {
+		o := *m.obs.load()
+		m.obs.store(&o) // NB: invalidates cached children, which were deleted
+	}
+}
+
+func (mw *Middleware) collectors() collectors {
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	return append(collectors(nil), mw.cs...)
+}
+
+// metricsFor returns the metrics of handlers with the given const labels,
+// which override the values of the middleware's const labels.
+func (mw *Middleware) metricsFor(labels prometheus.Labels) *metrics {
+	merged := make(prometheus.Labels, len(mw.constLabels))
+	for k, v := range mw.constLabels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		if _, ok := mw.constLabels[k]; !ok {
+			panic(fmt.Sprintf("httpprom: handler const label %q must be given by WithConstLabels", k))
+		}
+		merged[k] = v
+	}
+	key := labelsKey(merged)
+
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+	if m, ok := mw.children[key]; ok {
+		return m
+	}
+	n := len(mw.cs)
+	m := mw.newMetrics(merged)
+	mw.children[key] = &m
+	for _, r := range mw.registerers {
+		r.MustRegister(mw.cs[n:]...)
+	}
+	return &m
+}
+
+// The following constructors create metric vectors and add them to the
+// middleware's collectors, so that only the metrics that are enabled are
+// described, collected, registered, and reset.
+
+// addName adds a fully-qualified metric name to the set of metric names.
+func (mw *Middleware) addName(namespace, subsystem, name string) {
+	if mw.names == nil {
+		mw.names = make(map[string]bool)
+	}
+	mw.names[prometheus.BuildFQName(namespace, subsystem, name)] = true
+}
+
+func (mw *Middleware) newCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	vec := prometheus.NewCounterVec(opts, labels)
+	mw.cs = append(mw.cs, vec)
+	mw.addName(opts.Namespace, opts.Subsystem, opts.Name)
+	return vec
+}
+
+func (mw *Middleware) newGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	vec := prometheus.NewGaugeVec(opts, labels)
+	mw.cs = append(mw.cs, vec)
+	mw.addName(opts.Namespace, opts.Subsystem, opts.Name)
+	return vec
+}
+
+func (mw *Middleware) newHistogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	vec := prometheus.NewHistogramVec(opts, labels)
+	mw.cs = append(mw.cs, vec)
+	mw.addName(opts.Namespace, opts.Subsystem, opts.Name)
+	return vec
+}
+
+func (mw *Middleware) newSummaryVec(opts prometheus.SummaryOpts, labels []string) *prometheus.SummaryVec {
+	vec := prometheus.NewSummaryVec(opts, labels)
+	mw.cs = append(mw.cs, vec)
+	mw.addName(opts.Namespace, opts.Subsystem, opts.Name)
+	return vec
+}
+
+// Handler returns a handler that instruments the given handler with the given
+// name as the value of its handler label. It may be used to instrument an
+// entire handler, such as an existing http.ServeMux, under a single name.
+func (mw *Middleware) Handler(name string, handler http.Handler, options ...HandlerOption) http.Handler {
+	cfg := mw.handler(name, handler)
+	for _, opt := range options {
+		opt.applyHandlerOpt(cfg)
+	}
+	mw.bind(cfg)
+	return cfg
+}
+
+// NewHandler returns a handler that instruments the given handler with a new
+// Middleware with the given options, using operation as the value of its
+// handler label. Its signature mirrors otelhttp.NewHandler. The metrics may be
+// registered by WithRegisterer or collected by the Collector method of the
+// returned handler:
+//
+//	h := httpprom.NewHandler(handler, "api")
+//	registry.MustRegister(h.Collector())
+func NewHandler(handler http.Handler, operation string, options ...Option) *InstrumentedHandler {
+	mw := NewMiddleware(options...)
+	return &InstrumentedHandler{Handler: mw.Handler(operation, handler), mw: mw}
+}
+
+// FileServerHandler returns a handler that serves requests with the contents
+// of the given file system, like http.FileServer, and instruments them with
+// a new Middleware with the given options, using name as the value of its
+// handler label. Request metrics have an ext label, which is the lowercase
+// extension of the requested file for common static assets (e.g. ".js" or
+// ".css"), "none" if it has no extension, or "other" otherwise. Its metrics
+// may be collected like those of NewHandler.
+func FileServerHandler(name string, root http.FileSystem, options ...Option) *InstrumentedHandler {
+	ext := customLabelOpt("ext", fileExt, fileExts)
+	mw := NewMiddleware(append(options[:len(options):len(options)], ext)...)
+	return &InstrumentedHandler{Handler: mw.Handler(name, http.FileServer(root)), mw: mw}
+}
+
+// fileExt returns the lowercase extension of the requested file.
+func fileExt(r *http.Request) string {
+	if ext := path.Ext(r.URL.Path); ext != "" {
+		return strings.ToLower(ext)
+	}
+	return "none"
+}
+
+// fileExts are the extensions of common static assets
+// that are recorded by FileServerHandler.
+var fileExts = []string{
+	"none",
+	".css", ".js", ".mjs", ".map", ".wasm",
+	".html", ".htm", ".json", ".xml", ".txt",
+	".png", ".jpg", ".jpeg", ".gif", ".svg", ".ico", ".webp", ".avif",
+	".woff", ".woff2", ".ttf", ".otf", ".eot",
+	".pdf", ".mp4", ".webm", ".mp3",
+}
+
+// An InstrumentedHandler is a handler with its own Middleware,
+// as returned by NewHandler and FileServerHandler.
+type InstrumentedHandler struct {
+	http.Handler
+	mw *Middleware
+}
+
+// Collector returns a prometheus collector for the handler's metrics.
+func (h *InstrumentedHandler) Collector() prometheus.Collector {
+	return h.mw.Collector()
+}
+
+// ErrorHandler returns a handler that instruments the given error-returning
+// handler function with the given name as the value of its handler label.
+// Errors are counted if WithHandlerErrors is given.
+func (mw *Middleware) ErrorHandler(name string, fn func(http.ResponseWriter, *http.Request) error, options ...HandlerOption) http.Handler {
+	if fn == nil {
+		panic("httpprom: nil handler")
+	}
+	return mw.Handler(name, ErrorHandlerFunc(fn), options...)
+}
+
+// Wrap returns a handler that instruments the given handler. The value of its
+// handler label is derived from each request with the WithHandlerName function
+// or, if none is given, is the request's URL path.
+//
+// WARNING: URL paths have unbounded cardinality and may be chosen by clients.
+// Unless the set of paths is known to be small, a WithHandlerName function
+// that returns route templates should be used instead.
+func (mw *Middleware) Wrap(handler http.Handler, options ...HandlerOption) http.Handler {
+	cfg := mw.handler("", handler)
+	if cfg.nameFunc == nil {
+		cfg.nameFunc = urlPath
+	}
+	for _, opt := range options {
+		opt.applyHandlerOpt(cfg)
+	}
+	if cfg.deferName && cfg.name == "" && mw.defaultName == "" {
+		cfg.name = "unknown" // NB: used by metrics recorded before the name is resolved
+	}
+	mw.bind(cfg)
+	return cfg
+}
+
+// Instrument returns a decorator that instruments handlers like Handler with
+// the given name and options, so that it may be chained with other middleware.
+func (mw *Middleware) Instrument(name string, options ...HandlerOption) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		return mw.Handler(name, handler, options...)
+	}
+}
+
+// Chain returns a decorator that applies the given decorators in order, so
+// that the first is the outermost. For example, Chain(a, b)(h) is a(b(h)).
+func Chain(middleware ...func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(handler http.Handler) http.Handler {
+		for i := len(middleware) - 1; i >= 0; i-- {
+			handler = middleware[i](handler)
+		}
+		return handler
+	}
+}
+
+// patternHandler returns a handler registered to a ServeMux with the given
+// pattern, which is remembered separately from any name given by the options.
+func (mw *Middleware) patternHandler(pattern string, handler http.Handler, options ...HandlerOption) http.Handler {
+	cfg := mw.handler(pattern, handler)
+	cfg.pattern = pattern
+	if fn := pathDepthFunc(pattern, mw.pathDepth); fn != nil && mw.nameFunc == nil {
+		cfg.nameFunc = fn
+	}
+	for _, opt := range options {
+		opt.applyHandlerOpt(cfg)
+	}
+	if mw.patternName {
+		cfg.name = cfg.pattern
+		cfg.nameFunc = nil
+	}
+	mw.bind(cfg)
+	return cfg
+}
+
+func (mw *Middleware) handler(name string, handler http.Handler) *handlerConfig {
+	if handler == nil {
+		panic("httpprom: nil handler")
+	}
+	return &handlerConfig{
+		name:          name,
+		nameFunc:      mw.nameFunc,
+		deferName:     mw.deferName,
+		nameContext:   mw.nameContext,
+		skip:          mw.skipFuncFor(),
+		handler:       handler,
+		now:           mw.now,
+		lookupMethod:  mw.lookupMethodFunc(),
+		exemplar:      mw.exemplar,
+		queueTime:     mw.queueTime,
+		untilFlush:    mw.untilFlush,
+		trailerStatus: mw.trailerFunc,
+		sampleRate:    mw.sampleRate,
+		random:        mw.random,
+		clientClosed:  mw.clientClosed,
+		durationUnit:  mw.unit(),
+		maxActive:     int32(mw.maxInFlight),
+		pendingLabels: mw.pendingLabelsFunc(),
+	}
+}
+
+// bind binds the handler to its metrics after its options are applied.
+func (mw *Middleware) bind(cfg *handlerConfig) {
+	m := &mw.metrics
+	if cfg.constLabels != nil {
+		m = mw.metricsFor(cfg.constLabels)
+	}
+	cfg.inFlightBefore = pendingBeforeFunc(mw.inFlight)
+	cfg.inFlightDefer = pendingDeferFunc(mw.inFlight)
+	cfg.pendingBefore = pendingBeforeFunc(m.pending)
+	cfg.pendingDefer = pendingDeferFunc(m.pending)
+	cfg.queueBefore = histogramAfterFunc(m.queues)
+	cfg.rejectBefore = counterFunc(m.rejects)
+	cfg.panicRecover = counterFunc(m.panics)
+	cfg.errorAfter = counterFunc(m.errors)
+	cfg.emptyAfter = counterFunc(m.empties)
+	cfg.writeErrAfter = counterFunc(m.writeErrs)
+	cfg.hijack = hijackFuncFor(m.upgraded)
+	cfg.flush = counterFunc(m.flushes)
+	cfg.push = counterFunc(m.pushes)
+	cfg.pushFail = counterFunc(m.pushFailures)
+	cfg.pendingGauge = mw.metricPendingLabelsFunc(pendingName)
+	cfg.obs = m.obs
+	mw.bindChildren(cfg, m)
+}
+
+// bindChildren caches the handler's label values that don't vary by request,
+// and the children of its pending gauge and requests counter with them, so
+// that they're updated without looking them up for each request.
+func (mw *Middleware) bindChildren(cfg *handlerConfig, m *metrics) {
+	mw.mu.Lock() // NB: the labels may be changed by SetCodeEnabled
+	defer mw.mu.Unlock()
+	if cfg.disabled || cfg.nameFunc != nil || mw.method {
+		return
+	}
+	cfg.pendingStatic = cfg.pendingLabels(cfg.name, "")
+	cfg.staticObs = m.obs.load()
+	if f, ok := mw.metricLabels[pendingName]; m.pending != nil && !f.method {
+		glvs := cfg.pendingStatic
+		if ok {
+			glvs = cfg.pendingGauge(cfg.name, "")
+		}
+		cfg.pendingChild = m.pending.WithLabelValues(glvs...)
+	}
+	if len(mw.requestLabelNames()) > len(cfg.pendingStatic) {
+		return // NB: other labels vary by request
+	}
+	if _, ok := mw.allLabelFlags(); ok {
+		return // NB: other metrics' labels may vary by request
+	}
+	cfg.static = cfg.pendingStatic
+	cfg.requestChild = m.requests.WithLabelValues(cfg.static...)
+}
+
+// observersFor returns the observers of the given metrics.
+func (mw *Middleware) observersFor(m *metrics) *observers {
+	o := &observers{
+		requestLabels:     mw.requestLabelsFunc(),
+		requestAfter:      counterFunc(m.requests),
+		durationAfter:     histogramAfterFunc(m.durations),
+		summaryAfter:      summaryAfterFunc(m.summaries),
+		ttfbAfter:         histogramAfterFunc(m.ttfbs),
+		responseSizeAfter: histogramAfterFunc(m.responseSizes),
+		headerSizeAfter:   histogramAfterFunc(m.headerSizes),
+		requestSizeAfter:  histogramAfterFunc(m.requestSizes),
+		bodySizeAfter:     histogramAfterFunc(m.bodySizes),
+	}
+	if f, ok := mw.allLabelFlags(); ok {
+		// NB: the label values are derived once and shared by the metrics
+		labels := mw.requestLabelsWith(f)
+		o.requestLabels = labelsFuncFor(labels)
+		names := labelNames(labels)
+		o.defaultLabels = indexesOf(names, mw.requestLabelNames())
+		o.counterLabels = mw.metricLabelIndexes(requestsName, names)
+		o.durationLabels = mw.metricLabelIndexes(durationName, names)
+		o.respSizeLabels = mw.metricLabelIndexes(responseSizeName, names)
+		o.reqSizeLabels = mw.metricLabelIndexes(requestSizeName, names)
+	}
+	return o
+}
+
+func (mw *Middleware) skipFuncFor() func(*http.Request) bool {
+	if len(mw.skipPaths) == 0 {
+		return mw.skipFunc
+	}
+	paths := make(map[string]bool, len(mw.skipPaths))
+	for _, path := range mw.skipPaths {
+		paths[path] = true
+	}
+	fn := mw.skipFunc
+	return func(r *http.Request) bool {
+		return paths[r.URL.Path] || fn != nil && fn(r)
+	}
+}
+
+func (mw *Middleware) lookupMethodFunc() func(string) string {
+	lookup := lookupMethod
+	if mw.upperMethod {
+		lookup = lookupUpperMethod
+	}
+	if mw.methods == nil {
+		return lookup
+	}
+	allowed := make(map[string]bool)
+	for _, method := range mw.methods {
+		allowed[lookup(method)] = true
+	}
+	return func(method string) string {
+		if s := lookup(method); allowed[s] {
+			return s
+		}
+		return "other"
+	}
+}
+
+// labelInfo holds the values from which a request's labels are derived.
+type labelInfo struct {
+	r       *http.Request
+	handler string
+	method  string
+	code    int
+	header  http.Header // of the response
+}
+
+// A label is a variable label of the metrics.
+type label struct {
+	name  string
+	value func(*labelInfo) string
+}
+
+// labelFlags select the handler, method, and code labels of a metric.
+type labelFlags struct {
+	handler bool
+	method  bool
+	code    bool
+}
+
+// labelFlags returns the label flags shared by metrics without their own.
+func (mw *Middleware) labelFlags() labelFlags {
+	return labelFlags{handler: !mw.noHandler, method: mw.method, code: mw.code}
+}
+
+// pendingLabels returns the ordered labels of metrics that are updated
+// before the response is known. They're a prefix of the request labels.
+func (mw *Middleware) pendingLabels() []label {
+	return mw.pendingLabelsWith(mw.labelFlags())
+}
+
+func (mw *Middleware) pendingLabelsWith(f labelFlags) []label {
+	var labels []label
+	if f.handler {
+		n, def := mw.maxLabelLen, mw.defaultName
+		labels = append(labels, label{"handler", func(li *labelInfo) string {
+			if li.handler == "" {
+				return truncate(def, n)
+			}
+			return truncate(li.handler, n)
+		}})
+	}
+	if f.method {
+		labels = append(labels, label{"method", func(li *labelInfo) string { return li.method }})
+	}
+	return labels
+}
+
+// requestLabels returns the ordered labels of metrics that are updated
+// after the response is known.
+func (mw *Middleware) requestLabels() []label {
+	return mw.requestLabelsWith(mw.labelFlags())
+}
+
+func (mw *Middleware) requestLabelsWith(f labelFlags) []label {
+	labels := mw.pendingLabelsWith(f)
+	if f.code {
+		mapCode := lookupCode
+		if mw.codeMapper != nil {
+			mapCode = mw.codeMapper
+		}
+		labels = append(labels, label{"code", func(li *labelInfo) string { return mapCode(li.code) }})
+	}
+	if mw.codeClass {
+		labels = append(labels, label{"code_class", func(li *labelInfo) string { return lookupCodeClass(li.code) }})
+	}
+	if mw.host {
+		filter, n := mw.hostFilter, mw.maxLabelLen
+		labels = append(labels, label{"host", func(li *labelInfo) string {
+			if filter != nil {
+				return truncate(filter(li.r.Host), n)
+			}
+			return truncate(li.r.Host, n)
+		}})
+	}
+	if mw.scheme {
+		labels = append(labels, label{"scheme", func(li *labelInfo) string { return lookupScheme(li.r) }})
+	}
+	if mw.proto {
+		labels = append(labels, label{"proto", func(li *labelInfo) string { return lookupProto(li.r.Proto) }})
+	}
+	if fn := mw.traceFunc; fn != nil {
+		labels = append(labels, label{"trace", func(li *labelInfo) string { return fn(li.r.Context()) }})
+	}
+	if mw.outcome {
+		labels = append(labels, label{"outcome", func(li *labelInfo) string { return lookupOutcome(li.code) }})
+	}
+	if mw.cancellation {
+		labels = append(labels, label{"cancellation", func(li *labelInfo) string { return lookupCancellation(li.r.Context().Err()) }})
+	}
+	if mw.reqContent {
+		allowed := mw.contentTypeTable()
+		labels = append(labels, label{"content_type", func(li *labelInfo) string {
+			return lookupContentType(li.r.Header.Get("Content-Type"), allowed)
+		}})
+	}
+	if mw.respContent {
+		allowed := mw.contentTypeTable()
+		labels = append(labels, label{"response_content_type", func(li *labelInfo) string {
+			return lookupContentType(li.header.Get("Content-Type"), allowed)
+		}})
+	}
+	for _, c := range mw.custom {
+		c := c
+		labels = append(labels, label{c.name, func(li *labelInfo) string {
+			if v := c.value(li.r); c.allowed[v] {
+				return v
+			}
+			return "other"
+		}})
+	}
+	return labels
+}
+
+// contentTypeTable returns the set of allowed media types.
+func (mw *Middleware) contentTypeTable() map[string]bool {
+	if mw.contentTypes == nil {
+		return contentTypeTable
+	}
+	allowed := make(map[string]bool, len(mw.contentTypes))
+	for _, mediaType := range mw.contentTypes {
+		allowed[strings.ToLower(mediaType)] = true
+	}
+	return allowed
+}
+
+func labelNames(labels []label) []string {
+	names := make([]string, len(labels))
+	for i, l := range labels {
+		names[i] = l.name
+	}
+	return names
+}
+
+func labelValues(labels []label, li *labelInfo) []string {
+	lvs := make([]string, len(labels))
+	for i, l := range labels {
+		lvs[i] = l.value(li)
+	}
+	return lvs
+}
+
+func (mw *Middleware) pendingLabelNames() []string {
+	return labelNames(mw.pendingLabels())
+}
+
+func (mw *Middleware) pendingLabelsFunc() pendingLabelsFunc {
+	labels := mw.pendingLabels()
+	return func(handler, method string) []string {
+		return labelValues(labels, &labelInfo{handler: handler, method: method})
+	}
+}
+
+func pendingBeforeFunc(vec *prometheus.GaugeVec) updateFunc {
+	if vec == nil {
+		return nil
+	}
+	return func(lvs []string) {
+		vec.WithLabelValues(lvs...).Inc()
+	}
+}
+
+func pendingDeferFunc(vec *prometheus.GaugeVec) updateFunc {
+	if vec == nil {
+		return nil
+	}
+	return func(lvs []string) {
+		vec.WithLabelValues(lvs...).Dec()
+	}
+}
+
+func counterFunc(vec *prometheus.CounterVec) updateFunc {
+	if vec == nil {
+		return nil
+	}
+	return func(lvs []string) {
+		vec.WithLabelValues(lvs...).Inc()
+	}
+}
+
+func (mw *Middleware) requestLabelNames() []string {
+	return labelNames(mw.requestLabels())
+}
+
+func (mw *Middleware) requestLabelsFunc() labelsFunc {
+	return labelsFuncFor(mw.requestLabels())
+}
+
+func labelsFuncFor(labels []label) labelsFunc {
+	return func(r *http.Request, handler, method string, code int, header http.Header) []string {
+		return labelValues(labels, &labelInfo{r: r, handler: handler, method: method, code: code, header: header})
+	}
+}
+
+// metricLabelNames returns the ordered label names of the metric with the
+// given default name.
+func (mw *Middleware) metricLabelNames(metric string) []string {
+	f, ok := mw.metricLabels[metric]
+	switch {
+	case metric == pendingName && ok:
+		return labelNames(mw.pendingLabelsWith(f))
+	case metric == pendingName:
+		return mw.pendingLabelNames()
+	case ok:
+		return labelNames(mw.requestLabelsWith(f))
+	default:
+		return mw.requestLabelNames()
+	}
+}
+
+// allLabelFlags returns the flags of the labels of every request metric,
+// or false if they all have the request labels.
+func (mw *Middleware) allLabelFlags() (labelFlags, bool) {
+	all, ok := mw.labelFlags(), false
+	for metric, f := range mw.metricLabels {
+		if metric == pendingName {
+			continue
+		}
+		all.handler = all.handler || f.handler
+		all.method = all.method || f.method
+		all.code = all.code || f.code
+		ok = true
+	}
+	return all, ok
+}
+
+// metricLabelIndexes returns the indexes of the labels of the metric with the
+// given default name in all of the label names, or nil if the metric has the
+// request labels.
+func (mw *Middleware) metricLabelIndexes(metric string, all []string) labelIndexes {
+	f, ok := mw.metricLabels[metric]
+	if !ok {
+		return nil
+	}
+	return indexesOf(all, labelNames(mw.requestLabelsWith(f)))
+}
+
+// indexesOf returns the indexes of the names in all of the names.
+func indexesOf(all, names []string) labelIndexes {
+	x := make(labelIndexes, 0, len(names))
+	for i, name := range all {
+		if len(x) < len(names) && names[len(x)] == name {
+			x = append(x, i)
+		}
+	}
+	return x
+}
+
+// metricPendingLabelsFunc returns the pending labels func of the metric with
+// the given default name, or nil if the metric has the pending labels.
+func (mw *Middleware) metricPendingLabelsFunc(metric string) pendingLabelsFunc {
+	f, ok := mw.metricLabels[metric]
+	if !ok {
+		return nil
+	}
+	labels := mw.pendingLabelsWith(f)
+	return func(handler, method string) []string {
+		return labelValues(labels, &labelInfo{handler: handler, method: method})
+	}
+}
+
+func hijackFuncFor(vec *prometheus.GaugeVec) hijackFunc {
+	if vec == nil {
+		return nil
+	}
+	return func(lvs []string, conn net.Conn) net.Conn {
+		g := vec.WithLabelValues(lvs...)
+		g.Inc()
+		return &upgradedConn{Conn: conn, dec: g.Dec}
+	}
+}
+
+func histogramAfterFunc(vec *prometheus.HistogramVec) observeFunc {
+	if vec == nil {
+		return nil
+	}
+	return observeFuncFor(vec)
+}
+
+func summaryAfterFunc(vec *prometheus.SummaryVec) observeFunc {
+	if vec == nil {
+		return nil
+	}
+	return observeFuncFor(vec)
+}
+
+func observeFuncFor(vec prometheus.ObserverVec) observeFunc {
+	return func(lvs []string, value float64, exemplar prometheus.Labels) {
+		o := vec.WithLabelValues(lvs...)
+		if e, ok := o.(prometheus.ExemplarObserver); ok && exemplar != nil && validExemplar(exemplar) {
+			e.ObserveWithExemplar(value, exemplar)
+			return
+		}
+		o.Observe(value)
+	}
+}
+
+// validExemplar reports whether the exemplar labels would be accepted by
+// ObserveWithExemplar, which panics otherwise.
+func validExemplar(labels prometheus.Labels) bool {
+	var runes int
+	for name, value := range labels {
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") || !utf8.ValidString(value) {
+			return false
+		}
+		runes += utf8.RuneCountInString(name) + utf8.RuneCountInString(value)
+	}
+	return runes <= prometheus.ExemplarMaxRunes
+}
+
+// sizeBuckets are the default buckets for size histograms: 100B to 10MB.
+var sizeBuckets = prometheus.ExponentialBuckets(100, 10, 6)
+
+// headerSizeBuckets are the buckets for header size histograms: 64B to 32KB.
+var headerSizeBuckets = prometheus.ExponentialBuckets(64, 2, 10)
+
+// collector is a prometheus collector for all of a middleware's metrics,
+// including those created for handlers after it's registered.
+type collector struct{ mw *Middleware }
+
+func (c collector) Describe(ch chan<- *prometheus.Desc) {
+	c.mw.collectors().Describe(ch)
+}
+
+func (c collector) Collect(ch chan<- prometheus.Metric) {
+	c.mw.collectors().Collect(ch)
+}
+
+type collectors []prometheus.Collector
+
+func (cs collectors) replace(old, new prometheus.Collector) {
+	for i, c := range cs {
+		if c == old {
+			cs[i] = new
+		}
+	}
+}
+
+func (cs collectors) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range cs {
+		c.Describe(ch)
+	}
+}
+
+func (cs collectors) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range cs {
+		c.Collect(ch)
+	}
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// mergeLabels returns the union of the given labels,
+// with b's values taking precedence.
+func mergeLabels(a, b prometheus.Labels) prometheus.Labels {
+	merged := make(prometheus.Labels, len(a)+len(b))
+	for k, v := range a {
+		merged[k] = v
+	}
+	for k, v := range b {
+		merged[k] = v
+	}
+	return merged
+}
+
+// labelsKey returns a key that uniquely identifies the set of labels.
+func labelsKey(labels prometheus.Labels) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(0)
+		b.WriteString(labels[name])
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// upgradedConn decrements the upgraded connections gauge when it's closed.
+type upgradedConn struct {
+	net.Conn
+	once sync.Once
+	dec  func()
+}
+
+func (c *upgradedConn) Close() error {
+	c.once.Do(c.dec)
+	return c.Conn.Close()
+}
+
+// truncate returns s truncated to at most n runes, ending with an ellipsis
+// if it's truncated. If n isn't positive, s is returned unchanged.
+func truncate(s string, n int) string {
+	if n <= 0 || len(s) <= n || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	const ellipsis = "…"
+	i, runes := 0, 0
+	for j := range s {
+		if runes == n-1 {
+			i = j
+			break
+		}
+		runes++
+	}
+	return s[:i] + ellipsis
+}
+
+// headerSize returns the sum of the lengths of the header's names and values.
+func headerSize(h http.Header) int {
+	n := 0
+	for k, vs := range h {
+		for _, v := range vs {
+			n += len(k) + len(v)
+		}
+	}
+	return n
+}
+
+func urlPath(r *http.Request) string {
+	return r.URL.Path
+}
+
+// pathDepthFunc returns a function that names requests by up to the first n
+// segments of their URL paths, or nil if the pattern isn't a prefix with
+// fewer than n segments.
+func pathDepthFunc(pattern string, n int) func(*http.Request) string {
+	i := strings.IndexByte(pattern, '/')
+	if n <= 0 || i < 0 || !strings.HasSuffix(pattern, "/") || strings.Count(pattern[i:], "/")-1 >= n {
+		return nil
+	}
+	host := pattern[:i]
+	return func(r *http.Request) string {
+		path := r.URL.Path
+		for j, k := 1, 0; j < len(path); j++ {
+			if path[j] != '/' {
+				continue
+			}
+			if k++; k == n {
+				return host + path[:j+1]
+			}
+		}
+		return host + path
+	}
+}
+
+// randPool holds sources for sampling, so that concurrent requests
+// don't contend for the lock on the global source.
+var randPool = sync.Pool{
+	New: func() interface{} { return rand.New(rand.NewSource(rand.Int63())) },
+}
+
+// randomFloat64 returns a pseudo-random number in [0.0,1.0).
+func randomFloat64() float64 {
+	r := randPool.Get().(*rand.Rand)
+	f := r.Float64()
+	randPool.Put(r)
+	return f
+}
+
+func bodySize(size int64, body *countingReader) int64 {
+	if size < 0 {
+		return bodyRead(body)
+	}
+	return size
+}
+
+func bodyRead(body *countingReader) int64 {
+	if body != nil {
+		return body.n
+	}
+	return 0
+}
+
+func checkBuckets(name string, buckets []float64) {
+	for i := 1; i < len(buckets); i++ {
+		if buckets[i-1] >= buckets[i] {
+			panic(fmt.Sprintf("httpprom: %s buckets must be in increasing order: %v >= %v", name, buckets[i-1], buckets[i]))
+		}
+	}
+}
+
+// unit returns the unit of the duration histogram and summary.
+func (mw *Middleware) unit() time.Duration {
+	if mw.durationUnit == 0 {
+		return time.Second
+	}
+	return mw.durationUnit
+}
+
+// unitName returns the given name of a metric in seconds with the suffix of
+// the duration unit.
+func (mw *Middleware) unitName(name string) string {
+	if mw.unit() == time.Second {
+		return name
+	}
+	return strings.TrimSuffix(name, "_seconds") + "_" + durationUnits[mw.unit()].suffix
+}
+
+// unitHelp returns the duration unit for help texts.
+func (mw *Middleware) unitHelp() string {
+	return durationUnits[mw.unit()].help
+}
+
+// durationBucketsIn returns the duration buckets in the given unit.
+func (mw *Middleware) durationBucketsIn(unit time.Duration) []float64 {
+	buckets, from := prometheus.DefBuckets, time.Second
+	if len(mw.durationBuckets) > 0 {
+		buckets, from = mw.durationBuckets, mw.unit()
+	}
+	if from == unit {
+		return buckets
+	}
+	scaled := make([]float64, len(buckets))
+	for i, b := range buckets {
+		if from > unit {
+			scaled[i] = b * float64(from/unit)
+		} else {
+			scaled[i] = b / float64(unit/from)
+		}
+	}
+	return scaled
+}
+
+// inUnit returns the duration in the given unit.
+func inUnit(d, unit time.Duration) float64 {
+	if unit == time.Second {
+		return d.Seconds()
+	}
+	return float64(d) / float64(unit)
+}
+
+func orDefault(buckets, def []float64) []float64 {
+	if len(buckets) == 0 {
+		return def
+	}
+	return buckets
+}
@@ -0,0 +1,964 @@
+package httpprom
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMiddlewareHandler(t *testing.T) {
+	mw := NewMiddleware(WithCode())
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "foo")
+	})
+	h := mw.Handler("mux", mux)
+	for _, path := range []string{"/foo", "/bar"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="mux"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="mux"} 1
+		http_server_requests_total{code="404",handler="mux"} 1
+	`
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)))
+}
+
+func TestNewHandler(t *testing.T) {
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "api", WithCode(), WithoutPending())
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="api"} 1
+	`
+	check(t, testutil.CollectAndCompare(h.Collector(), strings.NewReader(expect)))
+}
+
+func TestFileServerHandler(t *testing.T) {
+	fsys := fstest.MapFS{
+		"index.html":  {Data: []byte("<html></html>")},
+		"app.JS":      {Data: []byte("main()")},
+		"site.css":    {Data: []byte("body{}")},
+		"secret.conf": {Data: []byte("x")},
+	}
+	h := FileServerHandler("static", http.FS(fsys), WithCode(), WithoutPending())
+	for _, path := range []string{"/", "/app.JS", "/site.css", "/site.css", "/secret.conf", "/missing.css"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",ext=".css",handler="static"} 2
+		http_server_requests_total{code="200",ext=".js",handler="static"} 1
+		http_server_requests_total{code="200",ext="none",handler="static"} 1
+		http_server_requests_total{code="200",ext="other",handler="static"} 1
+		http_server_requests_total{code="404",ext=".css",handler="static"} 1
+	`
+	check(t, testutil.CollectAndCompare(h.Collector(), strings.NewReader(expect)))
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mark := func(name string) func(http.Handler) http.Handler {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	mw := NewMiddleware(WithCode(), WithoutPending(), WithNameContext())
+	h := Chain(mark("outer"), mw.Instrument("api"), mark("inner"))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, _ := HandlerNameFromContext(r.Context())
+		order = append(order, name)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if diff := cmp.Diff([]string{"outer", "inner", "api"}, order); diff != "" {
+		t.Errorf("unexpected order diff:\n%s", diff)
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="api"} 1
+	`
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)))
+}
+
+func TestMiddlewareWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		expect string
+	}{
+		{
+			name: "URLPath",
+			expect: `
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/bar"} 1
+				http_server_requests_total{handler="/foo"} 1
+			`,
+		},
+		{
+			name: "WithDefaultHandlerName",
+			opts: []Option{
+				WithHandlerName(func(r *http.Request) string {
+					if r.URL.Path == "/foo" {
+						return "foo"
+					}
+					return ""
+				}),
+				WithDefaultHandlerName("unknown"),
+			},
+			expect: `
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="foo"} 1
+				http_server_requests_total{handler="unknown"} 1
+			`,
+		},
+		{
+			name: "WithHandlerName",
+			opts: []Option{WithHandlerName(func(r *http.Request) string {
+				return "route"
+			})},
+			expect: `
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="route"} 2
+			`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := NewMiddleware(tt.opts...)
+			h := mw.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for _, path := range []string{"/foo", "/bar"} {
+				h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+			}
+			check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(tt.expect), "http_server_requests_total"))
+		})
+	}
+}
+
+func TestMetricAccessors(t *testing.T) {
+	mw := NewMiddleware(WithDuration())
+	if mw.RequestsCounter() == nil || mw.PendingGauge() == nil || mw.DurationHistogram() == nil {
+		t.Error("expected enabled metrics")
+	}
+	if mw.ResponseSizeHistogram() != nil || mw.RequestSizeHistogram() != nil {
+		t.Error("unexpected disabled metrics")
+	}
+	reg := prometheus.NewPedanticRegistry()
+	check(t, reg.Register(mw.RequestsCounter()))
+	mw.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="test"} 1
+	`
+	check(t, testutil.GatherAndCompare(reg, strings.NewReader(expect)))
+}
+
+func TestMetricsHandler(t *testing.T) {
+	mw := NewMiddleware(WithoutPending())
+	mw.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	w := httptest.NewRecorder()
+	mw.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `http_server_requests_total{handler="test"} 1`
+	if body := w.Body.String(); !strings.Contains(body, want) {
+		t.Errorf("metrics body doesn't contain %q:\n%s", want, body)
+	}
+}
+
+func TestMetricsHandlerOpenMetrics(t *testing.T) {
+	mw := NewMiddleware(
+		WithoutPending(),
+		WithDuration(),
+		WithDurationBuckets([]float64{1}),
+		WithExemplarFromContext(func(ctx context.Context) prometheus.Labels {
+			return prometheus.Labels{"trace_id": "abc"}
+		}),
+	)
+	mw.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	w := httptest.NewRecorder()
+	mw.MetricsHandler().ServeHTTP(w, req)
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("unexpected content type: %q", ct)
+	}
+	body := w.Body.String()
+	want := `http_server_request_duration_seconds_bucket{handler="test",le="1.0"} 1 # {trace_id="abc"}`
+	if !strings.Contains(body, want) {
+		t.Errorf("metrics body doesn't contain %q:\n%s", want, body)
+	}
+	if !strings.HasSuffix(body, "# EOF\n") {
+		t.Errorf("metrics body doesn't end with EOF:\n%s", body)
+	}
+
+	w = httptest.NewRecorder()
+	mw.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if body := w.Body.String(); strings.Contains(body, "trace_id") {
+		t.Errorf("text format metrics body contains exemplar:\n%s", body)
+	}
+}
+
+func TestHandlerConstLabels(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	mw := NewMiddleware(WithConstLabels(prometheus.Labels{"tier": "standard"}), WithoutPending(), WithRegisterer(reg))
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handlers := []http.Handler{
+		mw.Handler("foo", noop),
+		mw.Handler("bar", noop, WithHandlerConstLabels(prometheus.Labels{"tier": "premium"})),
+		mw.Handler("baz", noop, WithHandlerConstLabels(prometheus.Labels{"tier": "premium"})),
+		mw.Handler("qux", noop, WithHandlerConstLabels(prometheus.Labels{"tier": "standard"})),
+	}
+	for _, h := range handlers {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="bar",tier="premium"} 1
+		http_server_requests_total{handler="baz",tier="premium"} 1
+		http_server_requests_total{handler="foo",tier="standard"} 1
+		http_server_requests_total{handler="qux",tier="standard"} 1
+	`
+	check(t, testutil.GatherAndCompare(reg, strings.NewReader(expect)))
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)))
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for undeclared const label")
+		}
+	}()
+	mw.Handler("quux", noop, WithHandlerConstLabels(prometheus.Labels{"region": "us"}))
+}
+
+func TestSetCodeEnabled(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	mw := NewMiddleware(WithConstLabels(prometheus.Labels{"tier": "standard"}))
+	check(t, reg.Register(mw.Collector()))
+	noop := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	handlers := []http.Handler{
+		mw.Handler("foo", noop),
+		mw.Handler("bar", noop, WithHandlerConstLabels(prometheus.Labels{"tier": "premium"})),
+	}
+	serve := func() {
+		for _, h := range handlers {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+		}
+	}
+	serve()
+	check(t, mw.SetCodeEnabled(true))
+	check(t, mw.SetCodeEnabled(true))
+	serve()
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="bar",tier="premium"} 0
+		http_server_requests_pending{handler="foo",tier="standard"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="bar",tier="premium"} 1
+		http_server_requests_total{code="200",handler="foo",tier="standard"} 1
+	`
+	check(t, testutil.GatherAndCompare(reg, strings.NewReader(expect)))
+	if _, err := mw.RequestsCounter().GetMetricWithLabelValues("foo", "200"); err != nil {
+		t.Errorf("requests counter doesn't have the code label: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				serve()
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		check(t, mw.SetCodeEnabled(i%2 == 1))
+		_, err := reg.Gather()
+		check(t, err)
+	}
+	wg.Wait()
+}
+
+func TestDeferredName(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		pending string
+	}{
+		{name: "NoDefault", pending: "unknown"},
+		{name: "Default", opts: []Option{WithDefaultHandlerName("default")}, pending: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			type routeKey struct{}
+			mw := NewMiddleware(append([]Option{
+				WithHandlerName(func(r *http.Request) string {
+					return *r.Context().Value(routeKey{}).(*string)
+				}),
+				WithDeferredName(),
+			}, tt.opts...)...)
+			h := mw.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				*r.Context().Value(routeKey{}).(*string) = "route" // NB: set while serving, like a router
+			}))
+			var route string
+			r := httptest.NewRequest("GET", "/foo", nil)
+			h.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), routeKey{}, &route)))
+			expect := `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="` + tt.pending + `"} 0
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="route"} 1
+			`
+			check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)))
+		})
+	}
+}
+
+func TestDeferredNameCounters(t *testing.T) {
+	type routeKey struct{}
+	mw := NewMiddleware(
+		WithHandlerName(func(r *http.Request) string {
+			return *r.Context().Value(routeKey{}).(*string)
+		}),
+		WithDeferredName(),
+		WithFlushTracking(),
+		WithHandlerErrors(),
+	)
+	h := mw.Wrap(ErrorHandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		*r.Context().Value(routeKey{}).(*string) = "route"
+		w.(http.Flusher).Flush()
+		return errors.New("failed")
+	}))
+	var route string
+	r := httptest.NewRequest("GET", "/foo", nil)
+	h.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), routeKey{}, &route)))
+	expect := `
+		# HELP http_server_handler_errors_total Total number of errors returned by HTTP server handlers.
+		# TYPE http_server_handler_errors_total counter
+		http_server_handler_errors_total{handler="route"} 1
+		# HELP http_server_response_flushes_total Total number of HTTP server response flushes.
+		# TYPE http_server_response_flushes_total counter
+		http_server_response_flushes_total{handler="route"} 1
+	`
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect),
+		"http_server_handler_errors_total", "http_server_response_flushes_total"))
+}
+
+func TestHandlerNameFromContext(t *testing.T) {
+	var name string
+	var ok bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok = HandlerNameFromContext(r.Context())
+	})
+	nameFunc := WithHandlerName(func(r *http.Request) string { return "route" })
+	NewMiddleware(nameFunc, WithNameContext()).Wrap(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	if !ok || name != "route" {
+		t.Errorf("HandlerNameFromContext() = %q, %v; want %q, true", name, ok, "route")
+	}
+	NewMiddleware(nameFunc).Wrap(handler).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+	if ok {
+		t.Errorf("HandlerNameFromContext() without WithNameContext = %q, true; want false", name)
+	}
+	if name, ok := HandlerNameFromContext(context.Background()); ok {
+		t.Errorf("HandlerNameFromContext(context.Background()) = %q, true; want false", name)
+	}
+}
+
+func TestSkip(t *testing.T) {
+	mw := NewMiddleware(
+		WithSkipPaths("/healthz"),
+		WithSkipFunc(func(r *http.Request) bool { return r.URL.Path == "/metrics" }),
+	)
+	var served int
+	h := mw.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }))
+	for _, path := range []string{"/foo", "/healthz", "/metrics"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	if served != 3 {
+		t.Errorf("unexpected served count: got %d; want 3", served)
+	}
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/foo"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/foo"} 1
+	`
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)))
+}
+
+func TestTTFB(t *testing.T) {
+	tests := []struct {
+		name  string
+		flush bool
+		write bool
+	}{
+		{
+			name:  "Write",
+			write: true,
+		},
+		{
+			name:  "FlushThenWrite",
+			flush: true,
+			write: true,
+		},
+		{
+			// NB: The header is written after the handler returns.
+			name: "NoWrite",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mw := NewMiddleware(WithTTFB(), withClock(tickingClock(250*time.Millisecond)))
+			h := mw.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.flush {
+					w.(http.Flusher).Flush()
+				}
+				if tt.write {
+					io.WriteString(w, "hello")
+				}
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			expect := `
+				# HELP http_server_request_ttfb_seconds Histogram of HTTP server request times to first byte in seconds.
+				# TYPE http_server_request_ttfb_seconds histogram
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.005"} 0
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.01"} 0
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.025"} 0
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.05"} 0
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.1"} 0
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.25"} 1
+				http_server_request_ttfb_seconds_bucket{handler="test",le="0.5"} 1
+				http_server_request_ttfb_seconds_bucket{handler="test",le="1"} 1
+				http_server_request_ttfb_seconds_bucket{handler="test",le="2.5"} 1
+				http_server_request_ttfb_seconds_bucket{handler="test",le="5"} 1
+				http_server_request_ttfb_seconds_bucket{handler="test",le="10"} 1
+				http_server_request_ttfb_seconds_bucket{handler="test",le="+Inf"} 1
+				http_server_request_ttfb_seconds_sum{handler="test"} 0.25
+				http_server_request_ttfb_seconds_count{handler="test"} 1
+			`
+			check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect), "http_server_request_ttfb_seconds"))
+		})
+	}
+}
+
+func TestCollectorFamilies(t *testing.T) {
+	optional := []struct {
+		opt  Option
+		name string
+	}{
+		{WithDuration(), "http_server_request_duration_seconds"},
+		{WithDurationSummary(nil), "http_server_request_duration_summary_seconds"},
+		{WithTTFB(), "http_server_request_ttfb_seconds"},
+		{WithResponseSize(), "http_server_response_size_bytes"},
+		{WithRequestSize(), "http_server_request_size_bytes"},
+		{WithMaxInFlight(1), "http_server_requests_rejected_total"},
+		{WithPanicRecovery(), "http_server_panics_total"},
+		{WithUpgradedConnections(), "http_server_connections_upgraded"},
+		{WithEmptyResponseTracking(), "http_server_empty_responses_total"},
+		{WithHandlerErrors(), "http_server_handler_errors_total"},
+		{WithGlobalInFlight(), "http_server_in_flight_requests"},
+		{WithResponseHeaderSize(), "http_server_response_header_bytes"},
+		{WithFlushTracking(), "http_server_response_flushes_total"},
+		{WithRequestBodySize(), "http_server_request_body_bytes"},
+		{WithQueueTime(func(*http.Request) (time.Time, bool) { return time.Time{}, false }), "http_server_request_queue_seconds"},
+		{WithWriteErrorTracking(), "http_server_response_write_errors_total"},
+		{WithServerErrors(), "http_server_errors_total"},
+	}
+	base := []string{"http_server_requests_pending", "http_server_requests_total"}
+	familiesTest := func(t *testing.T, opts []Option, want []string) {
+		t.Helper()
+		mw := NewMiddleware(opts...)
+		want = append([]string(nil), want...)
+		sort.Strings(want)
+		got := describeNames(mw.Collector())
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected diff:\n%s", diff)
+		}
+		if diff := cmp.Diff(got, mw.MetricNames()); diff != "" {
+			t.Errorf("unexpected metric names diff:\n%s", diff)
+		}
+	}
+	t.Run("Default", func(t *testing.T) {
+		familiesTest(t, nil, base)
+	})
+	t.Run("WithoutPending", func(t *testing.T) {
+		familiesTest(t, []Option{WithoutPending()}, []string{"http_server_requests_total"})
+	})
+	for _, o := range optional {
+		o := o
+		t.Run(o.name, func(t *testing.T) {
+			familiesTest(t, []Option{o.opt}, append(base, o.name))
+		})
+	}
+	t.Run("All", func(t *testing.T) {
+		opts := []Option{WithoutPending()}
+		want := []string{"http_server_requests_total"}
+		for _, o := range optional {
+			opts = append(opts, o.opt)
+			want = append(want, o.name)
+		}
+		opts = append(opts, WithPushTracking())
+		want = append(want, "http_server_pushes_total", "http_server_push_failures_total")
+		familiesTest(t, opts, want)
+	})
+	t.Run("Pushes", func(t *testing.T) {
+		familiesTest(t, []Option{WithPushTracking()}, append(base,
+			"http_server_pushes_total",
+			"http_server_push_failures_total",
+		))
+	})
+	t.Run("Durations", func(t *testing.T) {
+		familiesTest(t, []Option{WithDuration(), WithDurationSummary(nil), WithTTFB()}, append(base,
+			"http_server_request_duration_seconds",
+			"http_server_request_duration_summary_seconds",
+			"http_server_request_ttfb_seconds",
+		))
+	})
+	t.Run("Sizes", func(t *testing.T) {
+		familiesTest(t, []Option{WithoutPending(), WithResponseSize(), WithResponseHeaderSize(), WithRequestSize(), WithRequestBodySize()}, []string{
+			"http_server_requests_total",
+			"http_server_response_size_bytes",
+			"http_server_response_header_bytes",
+			"http_server_request_size_bytes",
+			"http_server_request_body_bytes",
+		})
+	})
+}
+
+func TestMetricNames(t *testing.T) {
+	mw := NewMiddleware(
+		WithNamespace("app"),
+		WithSubsystem("web"),
+		WithDuration(),
+		WithDurationUnit(time.Millisecond),
+		WithServerErrors(),
+		WithInfoMetric("build_info", prometheus.Labels{"version": "v1"}),
+		WithRequestsMetricName("requests_total"),
+	)
+	want := []string{
+		"app_web_build_info",
+		"app_web_http_server_errors_total",
+		"app_web_http_server_request_duration_ms",
+		"app_web_http_server_requests_pending",
+		"app_web_requests_total",
+	}
+	if diff := cmp.Diff(want, mw.MetricNames()); diff != "" {
+		t.Errorf("unexpected metric names diff:\n%s", diff)
+	}
+	if diff := cmp.Diff(describeNames(mw.Collector()), mw.MetricNames()); diff != "" {
+		t.Errorf("unexpected described names diff:\n%s", diff)
+	}
+}
+
+var fqNameRE = regexp.MustCompile(`fqName: "([^"]*)"`)
+
+// describeNames returns the sorted fully-qualified names of the metrics
+// described by the collector.
+func describeNames(c prometheus.Collector) []string {
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		c.Describe(ch)
+		close(ch)
+	}()
+	var names []string
+	for desc := range ch {
+		if m := fqNameRE.FindStringSubmatch(desc.String()); m != nil {
+			names = append(names, m[1])
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestLabelOrder(t *testing.T) {
+	labels := []struct {
+		opt   Option // NB: nil means enabled by default
+		name  string
+		value string
+	}{
+		{nil, "handler", "test"},
+		{WithMethod(), "method", "get"},
+		{WithCode(), "code", "200"},
+		{WithCodeClass(), "code_class", "2xx"},
+		{WithHost(), "host", "example.com"},
+		{WithScheme(), "scheme", "http"},
+		{WithProtocol(), "proto", "HTTP/1.1"},
+		{WithTraceIDLabel(func(context.Context) string { return "sampled" }), "trace", "sampled"},
+		{WithOutcome(), "outcome", "success"},
+		{WithCancellation(), "cancellation", "ok"},
+		{WithRequestContentType(), "content_type", "none"},
+		{WithResponseContentType(), "response_content_type", "text/html"},
+	}
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	for mask := 0; mask < 1<<len(labels); mask++ {
+		var opts []Option
+		var names, values, pending []string
+		for i, l := range labels {
+			enabled := mask&(1<<i) != 0
+			if l.opt == nil && !enabled {
+				opts = append(opts, WithoutHandlerLabel())
+			} else if l.opt != nil && enabled {
+				opts = append(opts, l.opt)
+			}
+			if !enabled {
+				continue
+			}
+			names = append(names, l.name)
+			values = append(values, l.value)
+			if l.name == "handler" || l.name == "method" {
+				pending = append(pending, l.name)
+			}
+		}
+		mw := NewMiddleware(opts...)
+		if diff := cmp.Diff(names, mw.requestLabelNames(), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("mask %b: unexpected request label names diff:\n%s", mask, diff)
+		}
+		if diff := cmp.Diff(values, mw.requestLabelsFunc()(r, "test", "get", 200, http.Header{"Content-Type": {"text/html"}}), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("mask %b: unexpected request label values diff:\n%s", mask, diff)
+		}
+		if diff := cmp.Diff(pending, mw.pendingLabelNames(), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("mask %b: unexpected pending label names diff:\n%s", mask, diff)
+		}
+		if diff := cmp.Diff(values[:len(pending)], mw.pendingLabelsFunc()("test", "get"), cmpopts.EquateEmpty()); diff != "" {
+			t.Errorf("mask %b: unexpected pending label values diff:\n%s", mask, diff)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	tests := []struct {
+		s   string
+		n   int
+		out string
+	}{
+		{"handler", 0, "handler"},
+		{"handler", -1, "handler"},
+		{"handler", 7, "handler"},
+		{"handler", 8, "handler"},
+		{"handler", 4, "han…"},
+		{"handler", 1, "…"},
+		{"héllo wörld", 5, "héll…"},
+		{"日本語のハンドラ", 4, "日本語…"},
+	}
+	for _, tt := range tests {
+		if got := truncate(tt.s, tt.n); got != tt.out {
+			t.Errorf("truncate(%q, %d) = %q; want %q", tt.s, tt.n, got, tt.out)
+		}
+	}
+}
+
+func TestExponentialDurationBuckets(t *testing.T) {
+	want := []float64{10e-6, 20e-6, 40e-6, 80e-6}
+	got := ExponentialDurationBuckets(10e-6, 2, 4)
+	if diff := cmp.Diff(want, got, cmpopts.EquateApprox(0, 1e-12)); diff != "" {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+	WithDurationBuckets(got) // NB: panics unless increasing
+}
+
+func TestBucketHelpers(t *testing.T) {
+	tests := []struct {
+		name    string
+		fn      func() []float64
+		buckets []float64
+		panics  bool
+	}{
+		{
+			name:    "linear",
+			fn:      func() []float64 { return LinearBuckets(0, 10, 3) },
+			buckets: []float64{0, 10, 20},
+		},
+		{
+			name:   "linearZeroCount",
+			fn:     func() []float64 { return LinearBuckets(0, 10, 0) },
+			panics: true,
+		},
+		{
+			name:   "linearZeroWidth",
+			fn:     func() []float64 { return LinearBuckets(0, 0, 3) },
+			panics: true,
+		},
+		{
+			name:    "exponential",
+			fn:      func() []float64 { return ExponentialBuckets(100, 10, 3) },
+			buckets: []float64{100, 1000, 10000},
+		},
+		{
+			name:   "exponentialZeroCount",
+			fn:     func() []float64 { return ExponentialBuckets(100, 10, 0) },
+			panics: true,
+		},
+		{
+			name:   "exponentialZeroStart",
+			fn:     func() []float64 { return ExponentialBuckets(0, 10, 3) },
+			panics: true,
+		},
+		{
+			name:   "exponentialUnitFactor",
+			fn:     func() []float64 { return ExponentialBuckets(100, 1, 3) },
+			panics: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Errorf("unexpected panic state: got %v; want panic: %v", r, tt.panics)
+				}
+			}()
+			if diff := cmp.Diff(tt.buckets, tt.fn()); diff != "" {
+				t.Errorf("unexpected diff:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestDurationBucketsIn(t *testing.T) {
+	mw := NewMiddleware(WithDurationUnit(time.Millisecond), WithDurationBuckets([]float64{5, 250, 1000}))
+	if diff := cmp.Diff([]float64{0.005, 0.25, 1}, mw.durationBucketsIn(time.Second)); diff != "" {
+		t.Errorf("unexpected buckets in seconds diff:\n%s", diff)
+	}
+	if diff := cmp.Diff([]float64{5, 250, 1000}, mw.durationBucketsIn(time.Millisecond)); diff != "" {
+		t.Errorf("unexpected buckets in milliseconds diff:\n%s", diff)
+	}
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for unsupported unit")
+		}
+	}()
+	WithDurationUnit(time.Minute)
+}
+
+func TestCheckBuckets(t *testing.T) {
+	tests := []struct {
+		name    string
+		buckets []float64
+		panics  bool
+	}{
+		{
+			name: "nil",
+		},
+		{
+			name:    "one",
+			buckets: []float64{1},
+		},
+		{
+			name:    "increasing",
+			buckets: []float64{0.1, 0.5, 1, 5},
+		},
+		{
+			name:    "equal",
+			buckets: []float64{0.1, 0.5, 0.5, 1},
+			panics:  true,
+		},
+		{
+			name:    "decreasing",
+			buckets: []float64{1, 0.5},
+			panics:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Errorf("unexpected panic state: got %v; want panic: %v", r, tt.panics)
+				}
+			}()
+			WithDurationBuckets(tt.buckets)
+		})
+	}
+}
+
+func TestMetricNameOpt(t *testing.T) {
+	tests := []struct {
+		name   string
+		metric string
+		panics bool
+	}{
+		{
+			name:   "valid",
+			metric: "app:http_requests_total",
+		},
+		{
+			name:   "empty",
+			panics: true,
+		},
+		{
+			name:   "leadingDigit",
+			metric: "2xx_total",
+			panics: true,
+		},
+		{
+			name:   "dash",
+			metric: "http-requests",
+			panics: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); (r != nil) != tt.panics {
+					t.Errorf("unexpected panic state: got %v; want panic: %v", r, tt.panics)
+				}
+			}()
+			WithRequestsMetricName(tt.metric)
+		})
+	}
+}
+
+func TestMetricHelpOpt(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for empty help")
+		}
+	}()
+	WithRequestsHelp("")
+}
+
+func TestSetCodeEnabledRegistered(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	mw := NewMiddleware(WithDuration(), WithDurationBuckets([]float64{1}))
+	mw.MustRegister(reg)
+	h := mw.Handler("foo", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if err := mw.SetCodeEnabled(true); err == nil {
+		t.Error("expected error from registry with inconsistent label names")
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="foo"} 2
+	`
+	check(t, testutil.GatherAndCompare(reg, strings.NewReader(expect), "http_server_requests_total"))
+	if _, err := mw.DurationHistogram().GetMetricWithLabelValues("foo"); err != nil {
+		t.Errorf("duration histogram has changed labels: %v", err)
+	}
+}
+
+func TestReservedConstLabels(t *testing.T) {
+	for _, name := range []string{"handler", "method", "code"} {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Errorf("expected panic for reserved const label %q", name)
+				}
+			}()
+			WithConstLabels(prometheus.Labels{name: "x"})
+		})
+	}
+}
+
+func TestConflictingLabelNames(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"CodeClass", []Option{WithCodeClass(), WithConstLabels(prometheus.Labels{"code_class": "x"})}},
+		{"Host", []Option{WithHost(), WithConstLabels(prometheus.Labels{"host": "x"})}},
+		{"ContentType", []Option{WithRequestContentType(), WithConstLabels(prometheus.Labels{"content_type": "x"})}},
+		{"HeaderLabel", []Option{WithHeaderLabel("tenant", "X-Tenant", nil), WithConstLabels(prometheus.Labels{"tenant": "x"})}},
+		{"ServerErrors", []Option{WithServerErrors(), WithConstLabels(prometheus.Labels{"kind": "x"})}},
+		{"DuplicateCustom", []Option{
+			WithHeaderLabel("tenant", "X-Tenant", nil),
+			WithContextLabel("tenant", func(context.Context) string { return "" }, nil),
+		}},
+		{"CustomBuiltin", []Option{WithScheme(), WithHeaderLabel("scheme", "X-Forwarded-Proto", nil)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if r := recover(); r == nil {
+					t.Error("expected panic for conflicting label names")
+				}
+			}()
+			NewMiddleware(tt.opts...)
+		})
+	}
+}
+
+func BenchmarkHandler(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "Default"},
+		{name: "WithCode", opts: []Option{WithCode()}},
+		{name: "WithMethod", opts: []Option{WithMethod()}},
+	}
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(b *testing.B) {
+			mw := NewMiddleware(bb.opts...)
+			h := mw.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				h.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func BenchmarkHandlerParallel(b *testing.B) {
+	benchmarks := []struct {
+		name string
+		opts []Option
+	}{
+		{name: "Default"},
+		{name: "WithCode", opts: []Option{WithCode()}},
+		{name: "WithMethod", opts: []Option{WithMethod()}},
+		{name: "WithDurationSampleRate", opts: []Option{WithDurationSampleRate(0.1)}},
+	}
+	for _, bb := range benchmarks {
+		b.Run(bb.name, func(b *testing.B) {
+			mw := NewMiddleware(bb.opts...)
+			h := mw.Handler("test", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest("GET", "/", nil)
+				for pb.Next() {
+					h.ServeHTTP(w, r)
+				}
+			})
+		})
+	}
+}
@@ -1,11 +1,22 @@
+// NB: the tests use method patterns, which require the Go 1.22 mux semantics
+// regardless of the go version in go.mod.
+//go:debug httpmuxgo121=0
+
 package httpprom
 
 import (
+	"bufio"
+	"context"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/client_golang/prometheus"
@@ -26,7 +37,7 @@ func TestServerMux(t *testing.T) {
 				# TYPE http_server_requests_pending gauge
 				http_server_requests_pending{handler="/"} 1
 				# HELP http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE http_server_requests_total gauge
+				# TYPE http_server_requests_total counter
 				http_server_requests_total{handler="/"} 3
 			`,
 		},
@@ -38,10 +49,74 @@ func TestServerMux(t *testing.T) {
 				# TYPE http_server_requests_pending gauge
 				http_server_requests_pending{handler="/"} 1
 				# HELP http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE http_server_requests_total gauge
+				# TYPE http_server_requests_total counter
 				http_server_requests_total{code="200",handler="/"} 3
 			`,
 		},
+		{
+			name:    "WithCodeClass",
+			muxOpts: []ServeMuxOption{WithCodeClass()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{code_class="2xx",handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithCodeAndCodeClass",
+			muxOpts: []ServeMuxOption{WithCode(), WithCodeClass()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{code="200",code_class="2xx",handler="/"} 3
+			`,
+		},
+		{
+			name: "WithHost",
+			muxOpts: []ServeMuxOption{WithHost(), WithHostFilter(func(host string) string {
+				return "example.com"
+			})},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",host="example.com"} 3
+			`,
+		},
+		{
+			name:    "WithProtocol",
+			muxOpts: []ServeMuxOption{WithProtocol()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",proto="HTTP/1.1"} 3
+			`,
+		},
+		{
+			name: "WithTraceIDLabel",
+			muxOpts: []ServeMuxOption{WithTraceIDLabel(func(ctx context.Context) string {
+				return "unsampled"
+			})},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",trace="unsampled"} 3
+			`,
+		},
 		{
 			name:    "WithMethod",
 			muxOpts: []ServeMuxOption{WithMethod()},
@@ -50,10 +125,70 @@ func TestServerMux(t *testing.T) {
 				# TYPE http_server_requests_pending gauge
 				http_server_requests_pending{handler="/",method="get"} 1
 				# HELP http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE http_server_requests_total gauge
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",method="get"} 3
+			`,
+		},
+		{
+			name:    "WithUppercaseMethod",
+			muxOpts: []ServeMuxOption{WithMethod(), WithUppercaseMethod()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/",method="GET"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",method="GET"} 3
+			`,
+		},
+		{
+			name:    "WithMethodFilter",
+			muxOpts: []ServeMuxOption{WithMethod(), WithMethodFilter([]string{http.MethodGet})},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/",method="get"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
 				http_server_requests_total{handler="/",method="get"} 3
 			`,
 		},
+		{
+			name:    "WithMethodFilterOther",
+			muxOpts: []ServeMuxOption{WithMethod(), WithMethodFilter([]string{http.MethodPost})},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/",method="other"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",method="other"} 3
+			`,
+		},
+		{
+			name:    "WithoutHandlerLabel",
+			muxOpts: []ServeMuxOption{WithoutHandlerLabel()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total 3
+			`,
+		},
+		{
+			name:    "WithoutHandlerLabelWithMethod",
+			muxOpts: []ServeMuxOption{WithoutHandlerLabel(), WithMethod()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{method="get"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{method="get"} 3
+			`,
+		},
 		{
 			name:    "WithConstLabels",
 			muxOpts: []ServeMuxOption{WithConstLabels(prometheus.Labels{"foo": "bar"})},
@@ -62,7 +197,7 @@ func TestServerMux(t *testing.T) {
 				# TYPE http_server_requests_pending gauge
 				http_server_requests_pending{foo="bar",handler="/"} 1
 				# HELP http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE http_server_requests_total gauge
+				# TYPE http_server_requests_total counter
 				http_server_requests_total{foo="bar",handler="/"} 3
 			`,
 		},
@@ -74,10 +209,116 @@ func TestServerMux(t *testing.T) {
 				# TYPE foobar_http_server_requests_pending gauge
 				foobar_http_server_requests_pending{handler="/"} 1
 				# HELP foobar_http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE foobar_http_server_requests_total gauge
+				# TYPE foobar_http_server_requests_total counter
 				foobar_http_server_requests_total{handler="/"} 3
 			`,
 		},
+		{
+			name:    "WithSubsystem",
+			muxOpts: []ServeMuxOption{WithSubsystem("myapp")},
+			expect: `
+				# HELP myapp_http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE myapp_http_server_requests_pending gauge
+				myapp_http_server_requests_pending{handler="/"} 1
+				# HELP myapp_http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE myapp_http_server_requests_total counter
+				myapp_http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithNamespaceAndSubsystem",
+			muxOpts: []ServeMuxOption{WithNamespace("foobar"), WithSubsystem("myapp")},
+			expect: `
+				# HELP foobar_myapp_http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE foobar_myapp_http_server_requests_pending gauge
+				foobar_myapp_http_server_requests_pending{handler="/"} 1
+				# HELP foobar_myapp_http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE foobar_myapp_http_server_requests_total counter
+				foobar_myapp_http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithMetricNames",
+			muxOpts: []ServeMuxOption{WithNamespace("foobar"), WithRequestsMetricName("reqs_total"), WithPendingMetricName("reqs_pending")},
+			expect: `
+				# HELP foobar_reqs_pending Number of HTTP server requests currently pending.
+				# TYPE foobar_reqs_pending gauge
+				foobar_reqs_pending{handler="/"} 1
+				# HELP foobar_reqs_total Total number of HTTP server requests completed.
+				# TYPE foobar_reqs_total counter
+				foobar_reqs_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithMaxLabelLength",
+			muxOpts: []ServeMuxOption{WithMaxLabelLength(4), WithHost()},
+			hndOpts: []HandlerOption{WithName("handler")},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="han…"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="han…",host="127…"} 3
+			`,
+		},
+		{
+			name:    "WithGlobalInFlight",
+			muxOpts: []ServeMuxOption{WithGlobalInFlight(), WithMethod(), WithoutPending()},
+			expect: `
+				# HELP http_server_in_flight_requests Number of HTTP server requests currently in flight.
+				# TYPE http_server_in_flight_requests gauge
+				http_server_in_flight_requests 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",method="get"} 3
+			`,
+		},
+		{
+			name: "WithInfoMetric",
+			muxOpts: []ServeMuxOption{
+				WithConstLabels(prometheus.Labels{"env": "prod"}),
+				WithInfoMetric("http_server_build_info", prometheus.Labels{"version": "v1.2.3"}),
+				WithoutPending(),
+			},
+			expect: `
+				# HELP http_server_build_info Information about the HTTP server.
+				# TYPE http_server_build_info gauge
+				http_server_build_info{env="prod",version="v1.2.3"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{env="prod",handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithHelp",
+			muxOpts: []ServeMuxOption{WithRequestsHelp("Requests."), WithPendingHelp("Pending requests.")},
+			expect: `
+				# HELP http_server_requests_pending Pending requests.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Requests.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name: "WithCodeMapper",
+			muxOpts: []ServeMuxOption{WithCode(), WithCodeMapper(func(code int) string {
+				if code < 400 {
+					return "ok"
+				}
+				return "fail"
+			})},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{code="ok",handler="/"} 3
+			`,
+		},
 		{
 			name:    "WithCodeAndMethod",
 			muxOpts: []ServeMuxOption{WithCode(), WithMethod()},
@@ -86,10 +327,165 @@ func TestServerMux(t *testing.T) {
 				# TYPE http_server_requests_pending gauge
 				http_server_requests_pending{handler="/",method="get"} 1
 				# HELP http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE http_server_requests_total gauge
+				# TYPE http_server_requests_total counter
 				http_server_requests_total{code="200",handler="/",method="get"} 3
 			`,
 		},
+		{
+			name:    "WithoutPending",
+			muxOpts: []ServeMuxOption{WithoutPending()},
+			expect: `
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithDuration",
+			muxOpts: []ServeMuxOption{WithDuration(), withClock(tickingClock(250 * time.Millisecond))},
+			expect: `
+				# HELP http_server_request_duration_seconds Histogram of HTTP server request durations in seconds.
+				# TYPE http_server_request_duration_seconds histogram
+				http_server_request_duration_seconds_bucket{handler="/",le="0.005"} 0
+				http_server_request_duration_seconds_bucket{handler="/",le="0.01"} 0
+				http_server_request_duration_seconds_bucket{handler="/",le="0.025"} 0
+				http_server_request_duration_seconds_bucket{handler="/",le="0.05"} 0
+				http_server_request_duration_seconds_bucket{handler="/",le="0.1"} 0
+				http_server_request_duration_seconds_bucket{handler="/",le="0.25"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="0.5"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="1"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="2.5"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="5"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="10"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="+Inf"} 3
+				http_server_request_duration_seconds_sum{handler="/"} 0.75
+				http_server_request_duration_seconds_count{handler="/"} 3
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithDurationBuckets",
+			muxOpts: []ServeMuxOption{WithDuration(), WithDurationBuckets([]float64{0.1, 1}), withClock(tickingClock(250 * time.Millisecond))},
+			expect: `
+				# HELP http_server_request_duration_seconds Histogram of HTTP server request durations in seconds.
+				# TYPE http_server_request_duration_seconds histogram
+				http_server_request_duration_seconds_bucket{handler="/",le="0.1"} 0
+				http_server_request_duration_seconds_bucket{handler="/",le="1"} 3
+				http_server_request_duration_seconds_bucket{handler="/",le="+Inf"} 3
+				http_server_request_duration_seconds_sum{handler="/"} 0.75
+				http_server_request_duration_seconds_count{handler="/"} 3
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithDurationLabels",
+			muxOpts: []ServeMuxOption{WithMethod(), WithDuration(), WithDurationBuckets([]float64{0.1, 1}), WithDurationLabels(true, false, true), withClock(tickingClock(250 * time.Millisecond))},
+			expect: `
+				# HELP http_server_request_duration_seconds Histogram of HTTP server request durations in seconds.
+				# TYPE http_server_request_duration_seconds histogram
+				http_server_request_duration_seconds_bucket{code="200",handler="/",le="0.1"} 0
+				http_server_request_duration_seconds_bucket{code="200",handler="/",le="1"} 3
+				http_server_request_duration_seconds_bucket{code="200",handler="/",le="+Inf"} 3
+				http_server_request_duration_seconds_sum{code="200",handler="/"} 0.75
+				http_server_request_duration_seconds_count{code="200",handler="/"} 3
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/",method="get"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/",method="get"} 3
+			`,
+		},
+		{
+			name:    "WithMetricLabels",
+			muxOpts: []ServeMuxOption{WithCode(), WithCounterLabels(false, true, true), WithPendingLabels(true, true)},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/",method="get"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{code="200",method="get"} 3
+			`,
+		},
+		{
+			name:    "WithDurationUnit",
+			muxOpts: []ServeMuxOption{WithDuration(), WithDurationUnit(time.Millisecond), withClock(tickingClock(250 * time.Millisecond))},
+			expect: `
+				# HELP http_server_request_duration_ms Histogram of HTTP server request durations in milliseconds.
+				# TYPE http_server_request_duration_ms histogram
+				http_server_request_duration_ms_bucket{handler="/",le="5"} 0
+				http_server_request_duration_ms_bucket{handler="/",le="10"} 0
+				http_server_request_duration_ms_bucket{handler="/",le="25"} 0
+				http_server_request_duration_ms_bucket{handler="/",le="50"} 0
+				http_server_request_duration_ms_bucket{handler="/",le="100"} 0
+				http_server_request_duration_ms_bucket{handler="/",le="250"} 3
+				http_server_request_duration_ms_bucket{handler="/",le="500"} 3
+				http_server_request_duration_ms_bucket{handler="/",le="1000"} 3
+				http_server_request_duration_ms_bucket{handler="/",le="2500"} 3
+				http_server_request_duration_ms_bucket{handler="/",le="5000"} 3
+				http_server_request_duration_ms_bucket{handler="/",le="10000"} 3
+				http_server_request_duration_ms_bucket{handler="/",le="+Inf"} 3
+				http_server_request_duration_ms_sum{handler="/"} 750
+				http_server_request_duration_ms_count{handler="/"} 3
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithDurationSummary",
+			muxOpts: []ServeMuxOption{WithDurationSummary(map[float64]float64{0.5: 0.05}), withClock(tickingClock(250 * time.Millisecond))},
+			expect: `
+				# HELP http_server_request_duration_summary_seconds Summary of HTTP server request durations in seconds.
+				# TYPE http_server_request_duration_summary_seconds summary
+				http_server_request_duration_summary_seconds{handler="/",quantile="0.5"} 0.25
+				http_server_request_duration_summary_seconds_sum{handler="/"} 0.75
+				http_server_request_duration_summary_seconds_count{handler="/"} 3
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
+		{
+			name:    "WithResponseSize",
+			muxOpts: []ServeMuxOption{WithResponseSize()},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+				# HELP http_server_response_size_bytes Histogram of HTTP server response sizes in bytes.
+				# TYPE http_server_response_size_bytes histogram
+				http_server_response_size_bytes_bucket{handler="/",le="100"} 3
+				http_server_response_size_bytes_bucket{handler="/",le="1000"} 3
+				http_server_response_size_bytes_bucket{handler="/",le="10000"} 3
+				http_server_response_size_bytes_bucket{handler="/",le="100000"} 3
+				http_server_response_size_bytes_bucket{handler="/",le="1e+06"} 3
+				http_server_response_size_bytes_bucket{handler="/",le="1e+07"} 3
+				http_server_response_size_bytes_bucket{handler="/",le="+Inf"} 3
+				http_server_response_size_bytes_sum{handler="/"} 0
+				http_server_response_size_bytes_count{handler="/"} 3
+			`,
+		},
 		{
 			name:    "WithName",
 			hndOpts: []HandlerOption{WithName("test")},
@@ -98,10 +494,37 @@ func TestServerMux(t *testing.T) {
 				# TYPE http_server_requests_pending gauge
 				http_server_requests_pending{handler="test"} 1
 				# HELP http_server_requests_total Total number of HTTP server requests completed.
-				# TYPE http_server_requests_total gauge
+				# TYPE http_server_requests_total counter
 				http_server_requests_total{handler="test"} 3
 			`,
 		},
+		{
+			name: "WithHandlerName",
+			muxOpts: []ServeMuxOption{WithHandlerName(func(r *http.Request) string {
+				return "custom"
+			})},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="custom"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="custom"} 3
+			`,
+		},
+		{
+			name:    "WithPatternAsName",
+			muxOpts: []ServeMuxOption{WithPatternAsName()},
+			hndOpts: []HandlerOption{WithName("test")},
+			expect: `
+				# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+				# TYPE http_server_requests_pending gauge
+				http_server_requests_pending{handler="/"} 1
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{handler="/"} 3
+			`,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -139,6 +562,103 @@ func TestServerMux(t *testing.T) {
 	}
 }
 
+func TestDurationHistogram(t *testing.T) {
+	mux := NewServeMux(WithDuration())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 3; i++ {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	reg := prometheus.NewPedanticRegistry()
+	check(t, reg.Register(mux.Collector()))
+	mfs, err := reg.Gather()
+	check(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "http_server_request_duration_seconds" {
+			continue
+		}
+		if typ := mf.GetType().String(); typ != "HISTOGRAM" {
+			t.Fatalf("unexpected type: %s", typ)
+		}
+		if n := len(mf.GetMetric()); n != 1 {
+			t.Fatalf("unexpected number of series: %d", n)
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		if n := h.GetSampleCount(); n != 3 {
+			t.Errorf("unexpected sample count: %d", n)
+		}
+		var bounds []float64
+		for _, b := range h.GetBucket() {
+			bounds = append(bounds, b.GetUpperBound())
+		}
+		if diff := cmp.Diff(prometheus.DefBuckets, bounds); diff != "" {
+			t.Errorf("unexpected buckets diff:\n%s", diff)
+		}
+		return
+	}
+	t.Fatal("duration histogram not found")
+}
+
+func TestExemplars(t *testing.T) {
+	type traceKey struct{}
+	mux := NewServeMux(
+		WithDuration(),
+		WithDurationBuckets([]float64{10}),
+		WithExemplarFromContext(func(ctx context.Context) prometheus.Labels {
+			return prometheus.Labels{"trace_id": ctx.Value(traceKey{}).(string)}
+		}),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, id := range []string{
+		"abc123",
+		strings.Repeat("x", prometheus.ExemplarMaxRunes), // NB: too long with the name
+		"\xff", // NB: invalid UTF-8
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		mux.ServeHTTP(httptest.NewRecorder(), r.WithContext(context.WithValue(r.Context(), traceKey{}, id)))
+	}
+	reg := prometheus.NewPedanticRegistry()
+	check(t, reg.Register(mux.Collector()))
+	mfs, err := reg.Gather()
+	check(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() != "http_server_request_duration_seconds" {
+			continue
+		}
+		h := mf.GetMetric()[0].GetHistogram()
+		if n := h.GetSampleCount(); n != 3 {
+			t.Errorf("unexpected sample count: %d", n)
+		}
+		lps := h.GetBucket()[0].GetExemplar().GetLabel()
+		if len(lps) != 1 || lps[0].GetName() != "trace_id" || lps[0].GetValue() != "abc123" {
+			t.Errorf("unexpected exemplar labels: %v", lps)
+		}
+		return
+	}
+	t.Fatal("duration histogram not found")
+}
+
+// withClock returns an option that replaces the middleware's clock.
+func withClock(now func() time.Time) Option {
+	return optFunc(func(mw *Middleware) { mw.now = now })
+}
+
+// withRandom returns an option that replaces the middleware's random source.
+func withRandom(random func() float64) Option {
+	return optFunc(func(mw *Middleware) { mw.random = random })
+}
+
+// tickingClock returns a clock that advances by step each time it's read.
+func tickingClock(step time.Duration) func() time.Time {
+	var mu sync.Mutex
+	t := time.Unix(0, 0)
+	return func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		t = t.Add(step)
+		return t
+	}
+}
+
 func check(t *testing.T, err error) {
 	if err != nil {
 		t.Helper()
@@ -146,43 +666,1200 @@ func check(t *testing.T, err error) {
 	}
 }
 
-func TestCoalesce(t *testing.T) {
+func TestRequestSize(t *testing.T) {
 	tests := []struct {
-		name string
-		in   []string
-		out  []string
+		name    string
+		body    io.Reader
+		read    bool
+		nilBody bool
+		expect  string
 	}{
 		{
-			name: "empty",
-			in:   []string{},
-			out:  []string{},
+			name: "ContentLength",
+			body: strings.NewReader("hello"),
+			expect: `
+				# HELP http_server_request_size_bytes Histogram of HTTP server request sizes in bytes.
+				# TYPE http_server_request_size_bytes histogram
+				http_server_request_size_bytes_bucket{handler="/",le="100"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="10000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="100000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+06"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+07"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="+Inf"} 1
+				http_server_request_size_bytes_sum{handler="/"} 5
+				http_server_request_size_bytes_count{handler="/"} 1
+			`,
 		},
 		{
-			name: "head",
-			in:   []string{"", "a", "b", "c"},
-			out:  []string{"a", "b", "c"},
+			// NB: A body of unknown length is sent chunked,
+			// so the server sees a ContentLength of -1.
+			name: "UnknownLengthRead",
+			body: io.MultiReader(strings.NewReader("hello")),
+			read: true,
+			expect: `
+				# HELP http_server_request_size_bytes Histogram of HTTP server request sizes in bytes.
+				# TYPE http_server_request_size_bytes histogram
+				http_server_request_size_bytes_bucket{handler="/",le="100"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="10000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="100000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+06"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+07"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="+Inf"} 1
+				http_server_request_size_bytes_sum{handler="/"} 5
+				http_server_request_size_bytes_count{handler="/"} 1
+			`,
 		},
 		{
-			name: "middle",
-			in:   []string{"a", "b", "", "c", "d"},
-			out:  []string{"a", "b", "c", "d"},
+			name: "UnknownLengthUnread",
+			body: io.MultiReader(strings.NewReader("hello")),
+			expect: `
+				# HELP http_server_request_size_bytes Histogram of HTTP server request sizes in bytes.
+				# TYPE http_server_request_size_bytes histogram
+				http_server_request_size_bytes_bucket{handler="/",le="100"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="10000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="100000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+06"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+07"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="+Inf"} 1
+				http_server_request_size_bytes_sum{handler="/"} 0
+				http_server_request_size_bytes_count{handler="/"} 1
+			`,
 		},
 		{
-			name: "tail",
-			in:   []string{"a", "b", "c", ""},
-			out:  []string{"a", "b", "c"},
+			// NB: A handler may be called directly with
+			// an unknown length and no body at all.
+			name:    "UnknownLengthNilBody",
+			nilBody: true,
+			expect: `
+				# HELP http_server_request_size_bytes Histogram of HTTP server request sizes in bytes.
+				# TYPE http_server_request_size_bytes histogram
+				http_server_request_size_bytes_bucket{handler="/",le="100"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="10000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="100000"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+06"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="1e+07"} 1
+				http_server_request_size_bytes_bucket{handler="/",le="+Inf"} 1
+				http_server_request_size_bytes_sum{handler="/"} 0
+				http_server_request_size_bytes_count{handler="/"} 1
+			`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := NewServeMux(WithRequestSize())
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				if tt.read {
+					io.Copy(io.Discard, r.Body)
+				}
+			})
+			if tt.nilBody {
+				req := httptest.NewRequest("POST", "/", nil)
+				req.ContentLength = -1
+				req.Body = nil
+				mux.ServeHTTP(httptest.NewRecorder(), req)
+			} else {
+				srv := httptest.NewServer(mux)
+				defer srv.Close()
+
+				req, err := http.NewRequest("POST", srv.URL, tt.body)
+				check(t, err)
+				resp, err := srv.Client().Do(req)
+				check(t, err)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(tt.expect), "http_server_request_size_bytes"))
+		})
+	}
+}
+
+func TestRequestBodySize(t *testing.T) {
+	mux := NewServeMux(WithRequestBodySize(), WithRequestSize())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil {
+			io.CopyN(io.Discard, r.Body, 5)
+			r.Body = io.NopCloser(strings.NewReader("replaced"))
+		}
+	})
+	req := httptest.NewRequest("POST", "/", strings.NewReader("hello world"))
+	body := req.Body
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	if req.Body != body {
+		t.Error("request body not restored")
+	}
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Body = nil
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+	expect := `
+		# HELP http_server_request_body_bytes Histogram of HTTP server request body bytes read by handlers.
+		# TYPE http_server_request_body_bytes histogram
+		http_server_request_body_bytes_bucket{handler="/",le="100"} 2
+		http_server_request_body_bytes_bucket{handler="/",le="1000"} 2
+		http_server_request_body_bytes_bucket{handler="/",le="10000"} 2
+		http_server_request_body_bytes_bucket{handler="/",le="100000"} 2
+		http_server_request_body_bytes_bucket{handler="/",le="1e+06"} 2
+		http_server_request_body_bytes_bucket{handler="/",le="1e+07"} 2
+		http_server_request_body_bytes_bucket{handler="/",le="+Inf"} 2
+		http_server_request_body_bytes_sum{handler="/"} 5
+		http_server_request_body_bytes_count{handler="/"} 2
+		# HELP http_server_request_size_bytes Histogram of HTTP server request sizes in bytes.
+		# TYPE http_server_request_size_bytes histogram
+		http_server_request_size_bytes_bucket{handler="/",le="100"} 2
+		http_server_request_size_bytes_bucket{handler="/",le="1000"} 2
+		http_server_request_size_bytes_bucket{handler="/",le="10000"} 2
+		http_server_request_size_bytes_bucket{handler="/",le="100000"} 2
+		http_server_request_size_bytes_bucket{handler="/",le="1e+06"} 2
+		http_server_request_size_bytes_bucket{handler="/",le="1e+07"} 2
+		http_server_request_size_bytes_bucket{handler="/",le="+Inf"} 2
+		http_server_request_size_bytes_sum{handler="/"} 11
+		http_server_request_size_bytes_count{handler="/"} 2
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_request_body_bytes", "http_server_request_size_bytes"))
+}
+
+func TestMetricLabelsDerivedOnce(t *testing.T) {
+	var calls int
+	mux := NewServeMux(
+		WithoutPending(),
+		WithTraceIDLabel(func(ctx context.Context) string {
+			calls++
+			return "sampled"
+		}),
+		WithCounterLabels(true, false, true),
+		WithDuration(), WithDurationLabels(false, true, false), WithDurationBuckets([]float64{1}),
+		WithResponseSize(), WithResponseSizeLabels(true, true, true), WithResponseSizeBuckets([]float64{1}),
+		WithRequestSize(),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if calls != 1 {
+		t.Errorf("unexpected trace label calls: got %d; want 1", calls)
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="/",trace="sampled"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_requests_total"))
+	names := map[string][]string{
+		"http_server_request_duration_seconds": {"method", "trace"},
+		"http_server_response_size_bytes":      {"handler", "method", "code", "trace"},
+		"http_server_request_size_bytes":       {"handler", "trace"},
+	}
+	for metric, want := range names {
+		if diff := cmp.Diff(want, mux.mw.metricLabelNames(metric)); diff != "" {
+			t.Errorf("unexpected %s label names diff:\n%s", metric, diff)
+		}
+	}
+}
+
+func TestSizeLabels(t *testing.T) {
+	mux := NewServeMux(
+		WithRequestSize(), WithRequestSizeLabels(false, true, false),
+		WithResponseSize(), WithResponseSizeLabels(true, false, true),
+		WithResponseSizeBuckets([]float64{100}),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/", strings.NewReader("hello world")))
+	expect := `
+		# HELP http_server_request_size_bytes Histogram of HTTP server request sizes in bytes.
+		# TYPE http_server_request_size_bytes histogram
+		http_server_request_size_bytes_bucket{method="post",le="100"} 1
+		http_server_request_size_bytes_bucket{method="post",le="1000"} 1
+		http_server_request_size_bytes_bucket{method="post",le="10000"} 1
+		http_server_request_size_bytes_bucket{method="post",le="100000"} 1
+		http_server_request_size_bytes_bucket{method="post",le="1e+06"} 1
+		http_server_request_size_bytes_bucket{method="post",le="1e+07"} 1
+		http_server_request_size_bytes_bucket{method="post",le="+Inf"} 1
+		http_server_request_size_bytes_sum{method="post"} 11
+		http_server_request_size_bytes_count{method="post"} 1
+		# HELP http_server_response_size_bytes Histogram of HTTP server response sizes in bytes.
+		# TYPE http_server_response_size_bytes histogram
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="100"} 1
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="+Inf"} 1
+		http_server_response_size_bytes_sum{code="200",handler="/"} 5
+		http_server_response_size_bytes_count{code="200",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_request_size_bytes", "http_server_response_size_bytes"))
+}
+
+func TestResponseSizeByCode(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	mux := NewServeMux(
+		WithRegisterer(reg),
+		WithoutPending(),
+		WithResponseSize(),
+		WithResponseSizeLabels(true, false, true),
+		WithResponseSizeBuckets([]float64{100}),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("missing") != "" {
+			http.Error(w, "no", http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, strings.Repeat("x", 1000))
+	})
+	for _, target := range []string{"/", "/?missing=1"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/"} 2
+		# HELP http_server_response_size_bytes Histogram of HTTP server response sizes in bytes.
+		# TYPE http_server_response_size_bytes histogram
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="100"} 0
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="+Inf"} 1
+		http_server_response_size_bytes_sum{code="200",handler="/"} 1000
+		http_server_response_size_bytes_count{code="200",handler="/"} 1
+		http_server_response_size_bytes_bucket{code="404",handler="/",le="100"} 1
+		http_server_response_size_bytes_bucket{code="404",handler="/",le="+Inf"} 1
+		http_server_response_size_bytes_sum{code="404",handler="/"} 3
+		http_server_response_size_bytes_count{code="404",handler="/"} 1
+	`
+	check(t, testutil.GatherAndCompare(reg, strings.NewReader(expect)))
+}
+
+func TestQueueTime(t *testing.T) {
+	type arrivalKey struct{}
+	mux := NewServeMux(
+		withClock(func() time.Time { return time.Unix(10, 0) }),
+		WithQueueTime(func(r *http.Request) (time.Time, bool) {
+			t, ok := r.Context().Value(arrivalKey{}).(time.Time)
+			return t, ok
+		}),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, arrival := range []time.Time{time.Unix(8, 0), time.Unix(11, 0)} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), arrivalKey{}, arrival))
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_request_queue_seconds Histogram of HTTP server request queue latencies in seconds.
+		# TYPE http_server_request_queue_seconds histogram
+		http_server_request_queue_seconds_bucket{handler="/",le="0.005"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="0.01"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="0.025"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="0.05"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="0.1"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="0.25"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="0.5"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="1"} 1
+		http_server_request_queue_seconds_bucket{handler="/",le="2.5"} 2
+		http_server_request_queue_seconds_bucket{handler="/",le="5"} 2
+		http_server_request_queue_seconds_bucket{handler="/",le="10"} 2
+		http_server_request_queue_seconds_bucket{handler="/",le="+Inf"} 2
+		http_server_request_queue_seconds_sum{handler="/"} 2
+		http_server_request_queue_seconds_count{handler="/"} 2
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_request_queue_seconds"))
+}
+
+func TestMaxInFlight(t *testing.T) {
+	mux := NewServeMux(WithCode(), WithMaxInFlight(1))
+	started, release := make(chan struct{}), make(chan struct{})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	<-started
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected code: got %d; want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	close(release)
+	<-done
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="/"} 1
+		# HELP http_server_requests_rejected_total Total number of HTTP server requests rejected by the in-flight limit.
+		# TYPE http_server_requests_rejected_total counter
+		http_server_requests_rejected_total{handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect),
+		"http_server_requests_pending", "http_server_requests_total", "http_server_requests_rejected_total"))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	mux := NewServeMux(WithCode(), WithPanicRecovery())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("unexpected recovered value: %v", r)
+			}
+		}()
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}()
+	expect := `
+		# HELP http_server_panics_total Total number of HTTP server handler panics.
+		# TYPE http_server_panics_total counter
+		http_server_panics_total{handler="/"} 1
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="500",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestHijack(t *testing.T) {
+	mux := NewServeMux(WithCode())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		check(t, err)
+		conn.Close()
+	})
+	w := hijackRecorder{httptest.NewRecorder()}
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="101",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestUpgradedConnections(t *testing.T) {
+	mux := NewServeMux(WithUpgradedConnections(), WithoutPending())
+	conns := make(chan net.Conn, 1)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		conn, _, err := w.(http.Hijacker).Hijack()
+		check(t, err)
+		conns <- conn
+	})
+	mux.ServeHTTP(hijackRecorder{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil))
+	gauge := func(v string) string {
+		return `
+			# HELP http_server_connections_upgraded Number of HTTP server connections currently upgraded.
+			# TYPE http_server_connections_upgraded gauge
+			http_server_connections_upgraded{handler="/"} ` + v + `
+		`
+	}
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(gauge("1")), "http_server_connections_upgraded"))
+	conn := <-conns
+	conn.Close()
+	conn.Close() // NB: Closing twice must only decrement once.
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(gauge("0")), "http_server_connections_upgraded"))
+}
+
+func TestConnect(t *testing.T) {
+	tests := []struct {
+		name   string
+		hijack bool
+		code   string
+	}{
+		{
+			name:   "Tunnel",
+			hijack: true,
+			code:   "200",
 		},
 		{
-			name: "many",
-			in:   []string{"", "", "a", "", "", "", "b", "", "c", "d", "", ""},
-			out:  []string{"a", "b", "c", "d"},
+			name: "Refused",
+			code: "403",
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if diff := cmp.Diff(coalesce(tt.in...), tt.out); diff != "" {
-				t.Errorf("unexpected diff:\n%s", diff)
-			}
+			mw := NewMiddleware(WithCode(), WithMethod())
+			h := mw.Handler("proxy", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !tt.hijack {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				conn, _, err := w.(http.Hijacker).Hijack()
+				check(t, err)
+				conn.Close()
+			}))
+			h.ServeHTTP(hijackRecorder{httptest.NewRecorder()}, httptest.NewRequest("CONNECT", "http://example.com:443", nil))
+			expect := `
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{code="` + tt.code + `",handler="proxy",method="connect"} 1
+			`
+			check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect), "http_server_requests_total"))
 		})
 	}
 }
+
+// hijackRecorder is a ResponseRecorder that supports hijacking.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+}
+
+func (w hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, peer := net.Pipe()
+	peer.Close()
+	return conn, bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn)), nil
+}
+
+func TestWriteHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		codes []int
+		write bool
+		code  string
+	}{
+		{
+			name:  "Once",
+			codes: []int{http.StatusNotFound},
+			code:  "404",
+		},
+		{
+			name:  "Superfluous",
+			codes: []int{http.StatusNotFound, http.StatusInternalServerError},
+			code:  "404",
+		},
+		{
+			name:  "Informational",
+			codes: []int{http.StatusEarlyHints, http.StatusNotFound},
+			code:  "404",
+		},
+		{
+			name:  "ImplicitAfterInformational",
+			codes: []int{http.StatusEarlyHints},
+			write: true,
+			code:  "200",
+		},
+		{
+			name:  "OnlyInformational",
+			codes: []int{http.StatusEarlyHints},
+			code:  "200",
+		},
+		{
+			name:  "Implicit",
+			write: true,
+			code:  "200",
+		},
+		{
+			name: "Empty",
+			code: "200",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mux := NewServeMux(WithCode())
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				for _, code := range tt.codes {
+					w.WriteHeader(code)
+				}
+				if tt.write {
+					io.WriteString(w, "hello")
+				}
+			})
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+			expect := `
+				# HELP http_server_requests_total Total number of HTTP server requests completed.
+				# TYPE http_server_requests_total counter
+				http_server_requests_total{code="` + tt.code + `",handler="/"} 1
+			`
+			check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_requests_total"))
+		})
+	}
+}
+
+func TestDelegatorReuse(t *testing.T) {
+	mux := NewServeMux(WithCode(), WithResponseSize(), WithResponseSizeBuckets([]float64{100}))
+	mux.HandleFunc("/missing", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 10; i++ {
+		for _, path := range []string{"/missing", "/"} {
+			mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		}
+	}
+	expect := `
+		# HELP http_server_response_size_bytes Histogram of HTTP server response sizes in bytes.
+		# TYPE http_server_response_size_bytes histogram
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="100"} 10
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="+Inf"} 10
+		http_server_response_size_bytes_sum{code="200",handler="/"} 0
+		http_server_response_size_bytes_count{code="200",handler="/"} 10
+		http_server_response_size_bytes_bucket{code="404",handler="/missing",le="100"} 10
+		http_server_response_size_bytes_bucket{code="404",handler="/missing",le="+Inf"} 10
+		http_server_response_size_bytes_sum{code="404",handler="/missing"} 190
+		http_server_response_size_bytes_count{code="404",handler="/missing"} 10
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_response_size_bytes"))
+}
+
+func TestReadFrom(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "content")
+	check(t, err)
+	defer f.Close()
+	_, err = f.WriteString(strings.Repeat("x", 1000))
+	check(t, err)
+
+	mux := NewServeMux(WithCode(), WithResponseSize(), WithResponseSizeBuckets([]float64{1000}))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(io.ReaderFrom); !ok {
+			t.Error("response writer doesn't implement io.ReaderFrom")
+		}
+		if r.URL.Query().Get("hints") != "" {
+			w.WriteHeader(http.StatusEarlyHints)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Error(err)
+		}
+		io.Copy(w, f)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	for _, url := range []string{srv.URL, srv.URL + "?hints=1"} {
+		resp, err := srv.Client().Get(url)
+		check(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	expect := `
+		# HELP http_server_response_size_bytes Histogram of HTTP server response sizes in bytes.
+		# TYPE http_server_response_size_bytes histogram
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="1000"} 2
+		http_server_response_size_bytes_bucket{code="200",handler="/",le="+Inf"} 2
+		http_server_response_size_bytes_sum{code="200",handler="/"} 2000
+		http_server_response_size_bytes_count{code="200",handler="/"} 2
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_response_size_bytes"))
+}
+
+func TestEmptyResponses(t *testing.T) {
+	mux := NewServeMux(WithEmptyResponseTracking())
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/body", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	mux.HandleFunc("/error", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+	for _, req := range []struct{ method, path string }{
+		{"GET", "/empty"},
+		{"GET", "/empty"},
+		{"HEAD", "/empty"},
+		{"GET", "/body"},
+		{"GET", "/error"},
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+	expect := `
+		# HELP http_server_empty_responses_total Total number of HTTP server responses with a 200 status and an empty body.
+		# TYPE http_server_empty_responses_total counter
+		http_server_empty_responses_total{handler="/empty"} 2
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_empty_responses_total"))
+}
+
+// failingWriter is a response writer whose writes fail
+// with io.ErrClosedPipe and then io.ErrShortWrite.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	failed bool
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.failed {
+		return 0, io.ErrShortWrite
+	}
+	w.failed = true
+	return 0, io.ErrClosedPipe
+}
+
+func TestWriteErrors(t *testing.T) {
+	mux := NewServeMux(WithWriteErrorTracking(), WithoutPending())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "a")
+		io.WriteString(w, "b")
+		var want error
+		if r.URL.Query().Get("fail") != "" {
+			want = io.ErrClosedPipe // NB: the first error
+		}
+		if err := w.(interface{ Err() error }).Err(); err != want {
+			t.Errorf("unexpected write error: got %v; want %v", err, want)
+		}
+	})
+	mux.ServeHTTP(&failingWriter{ResponseRecorder: httptest.NewRecorder()}, httptest.NewRequest("GET", "/?fail=1", nil))
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_response_write_errors_total Total number of HTTP server responses with write errors.
+		# TYPE http_server_response_write_errors_total counter
+		http_server_response_write_errors_total{handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_response_write_errors_total"))
+}
+
+// fakePusher is a response writer that supports pushing
+// all targets except those prefixed by "/fail".
+type fakePusher struct {
+	*httptest.ResponseRecorder
+	pushed []string
+}
+
+func (w *fakePusher) Push(target string, opts *http.PushOptions) error {
+	if strings.HasPrefix(target, "/fail") {
+		return http.ErrNotSupported
+	}
+	w.pushed = append(w.pushed, target)
+	return nil
+}
+
+func TestPushTracking(t *testing.T) {
+	mux := NewServeMux(WithPushTracking(), WithoutPending())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		p, ok := w.(http.Pusher)
+		if !ok {
+			t.Fatal("response writer doesn't implement http.Pusher")
+		}
+		for _, target := range []string{"/app.js", "/app.css", "/fail.js"} {
+			p.Push(target, nil)
+		}
+	})
+	w := &fakePusher{ResponseRecorder: httptest.NewRecorder()}
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if diff := cmp.Diff([]string{"/app.js", "/app.css"}, w.pushed); diff != "" {
+		t.Errorf("unexpected pushed targets diff:\n%s", diff)
+	}
+	expect := `
+		# HELP http_server_push_failures_total Total number of HTTP/2 server pushes that failed.
+		# TYPE http_server_push_failures_total counter
+		http_server_push_failures_total{handler="/"} 1
+		# HELP http_server_pushes_total Total number of HTTP/2 server pushes attempted.
+		# TYPE http_server_pushes_total counter
+		http_server_pushes_total{handler="/"} 3
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_pushes_total", "http_server_push_failures_total"))
+}
+
+func TestCancellation(t *testing.T) {
+	mux := NewServeMux(WithCancellation())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{cancellation="canceled",handler="/"} 1
+		http_server_requests_total{cancellation="ok",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestResponseHeaderSize(t *testing.T) {
+	mux := NewServeMux(WithResponseHeaderSize())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")       // 12 + 10
+		w.Header()["X-Multi"] = []string{"a", "bb"}        // 7+1 + 7+2
+		w.Header().Set("X-Long", strings.Repeat("x", 100)) // 6 + 100
+		io.WriteString(w, "hello")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_response_header_bytes Histogram of HTTP server response header sizes in bytes, approximated by the lengths of header names and values without HTTP framing.
+		# TYPE http_server_response_header_bytes histogram
+		http_server_response_header_bytes_bucket{handler="/",le="64"} 0
+		http_server_response_header_bytes_bucket{handler="/",le="128"} 0
+		http_server_response_header_bytes_bucket{handler="/",le="256"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="512"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="1024"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="2048"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="4096"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="8192"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="16384"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="32768"} 1
+		http_server_response_header_bytes_bucket{handler="/",le="+Inf"} 1
+		http_server_response_header_bytes_sum{handler="/"} 145
+		http_server_response_header_bytes_count{handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_response_header_bytes"))
+}
+
+func TestFlushTracking(t *testing.T) {
+	mux := NewServeMux(WithFlushTracking())
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "event\n")
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, path := range []string{"/stream", "/"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_response_flushes_total Total number of HTTP server response flushes.
+		# TYPE http_server_response_flushes_total counter
+		http_server_response_flushes_total{handler="/stream"} 3
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_response_flushes_total"))
+}
+
+func TestUnwrap(t *testing.T) {
+	rec := httptest.NewRecorder()
+	mux := NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			t.Fatal("response writer doesn't implement Unwrap")
+		}
+		if got := u.Unwrap(); got != rec {
+			t.Errorf("unexpected unwrapped response writer: %T", got)
+		}
+	})
+	mux.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+}
+
+func TestDurationUntilFirstFlush(t *testing.T) {
+	mux := NewServeMux(
+		WithDuration(), WithDurationBuckets([]float64{1}), WithDurationUntilFirstFlush(),
+		withClock(tickingClock(250*time.Millisecond)),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 3; i++ {
+			io.WriteString(w, "event\n")
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_request_duration_seconds Histogram of HTTP server request durations in seconds.
+		# TYPE http_server_request_duration_seconds histogram
+		http_server_request_duration_seconds_bucket{handler="/",le="1"} 1
+		http_server_request_duration_seconds_bucket{handler="/",le="+Inf"} 1
+		http_server_request_duration_seconds_sum{handler="/"} 0.5
+		http_server_request_duration_seconds_count{handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_request_duration_seconds"))
+}
+
+func TestOutcome(t *testing.T) {
+	mux := NewServeMux(WithOutcome(), WithoutPending())
+	for _, code := range []int{http.StatusOK, http.StatusNotFound, http.StatusServiceUnavailable} {
+		code := code
+		mux.HandleFunc("/"+strconv.Itoa(code), func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		})
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+strconv.Itoa(code), nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/200",outcome="success"} 1
+		http_server_requests_total{handler="/404",outcome="success"} 1
+		http_server_requests_total{handler="/503",outcome="error"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestRequestContentType(t *testing.T) {
+	mux := NewServeMux(WithRequestContentType(), WithContentTypeAllowlist("application/JSON", "application/x-protobuf"), WithoutPending())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, contentType := range []string{"", "application/json; charset=utf-8", "application/x-protobuf", "text/plain"} {
+		req := httptest.NewRequest("POST", "/", nil)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{content_type="application/json",handler="/"} 1
+		http_server_requests_total{content_type="application/x-protobuf",handler="/"} 1
+		http_server_requests_total{content_type="none",handler="/"} 1
+		http_server_requests_total{content_type="other",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestResponseContentType(t *testing.T) {
+	mux := NewServeMux(WithResponseContentType(), WithoutPending())
+	mux.HandleFunc("/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		io.WriteString(w, "{}")
+	})
+	mux.HandleFunc("/sniffed", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "<html></html>")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	for _, path := range []string{"/json", "/sniffed"} {
+		resp, err := srv.Client().Get(srv.URL + path)
+		check(t, err)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/json",response_content_type="application/json"} 1
+		http_server_requests_total{handler="/sniffed",response_content_type="none"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestHeaderLabel(t *testing.T) {
+	mux := NewServeMux(
+		WithHeaderLabel("api_version", "x-api-version", []string{"v1", "v2"}),
+		WithHeaderLabel("tenant", "X-Tenant", []string{"", "acme"}),
+		WithoutPending(),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, hdr := range []struct{ version, tenant string }{
+		{"v1", "acme"},
+		{"v2", ""},
+		{"v3", "initech"},
+		{"", "acme"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if hdr.version != "" {
+			req.Header.Set("X-Api-Version", hdr.version)
+		}
+		if hdr.tenant != "" {
+			req.Header.Set("X-Tenant", hdr.tenant)
+		}
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{api_version="other",handler="/",tenant="acme"} 1
+		http_server_requests_total{api_version="other",handler="/",tenant="other"} 1
+		http_server_requests_total{api_version="v1",handler="/",tenant="acme"} 1
+		http_server_requests_total{api_version="v2",handler="/",tenant=""} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic for invalid label name")
+		}
+	}()
+	WithHeaderLabel("api-version", "X-Api-Version", nil)
+}
+
+func TestContextLabel(t *testing.T) {
+	type tenantKey struct{}
+	type planKey struct{}
+	value := func(key interface{}) func(context.Context) string {
+		return func(ctx context.Context) string {
+			v, _ := ctx.Value(key).(string)
+			return v
+		}
+	}
+	mux := NewServeMux(
+		WithContextLabel("tenant", value(tenantKey{}), []string{"acme"}),
+		WithHeaderLabel("api_version", "X-Api-Version", []string{"v1"}),
+		WithContextLabel("plan", value(planKey{}), []string{"free", "pro"}),
+		WithoutPending(),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for _, ctx := range []struct{ tenant, plan string }{
+		{"acme", "pro"},
+		{"initech", "free"},
+		{"acme", "enterprise"},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-Api-Version", "v1")
+		c := context.WithValue(req.Context(), tenantKey{}, ctx.tenant)
+		c = context.WithValue(c, planKey{}, ctx.plan)
+		mux.ServeHTTP(httptest.NewRecorder(), req.WithContext(c))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{api_version="v1",handler="/",plan="free",tenant="other"} 1
+		http_server_requests_total{api_version="v1",handler="/",plan="other",tenant="acme"} 1
+		http_server_requests_total{api_version="v1",handler="/",plan="pro",tenant="acme"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+	if diff := cmp.Diff([]string{"handler", "tenant", "api_version", "plan"}, mux.mw.requestLabelNames()); diff != "" {
+		t.Errorf("unexpected label names diff:\n%s", diff)
+	}
+}
+
+func TestTrailerStatus(t *testing.T) {
+	mux := NewServeMux(
+		WithCode(),
+		WithoutPending(),
+		WithTrailerStatus(func(h http.Header) (int, bool) {
+			switch h.Get("Grpc-Status") {
+			case "":
+				return 0, false
+			case "0":
+				return http.StatusOK, true
+			case "5":
+				return http.StatusNotFound, true
+			default:
+				return http.StatusInternalServerError, true
+			}
+		}),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Grpc-Status", r.URL.Query().Get("status"))
+	})
+	for _, target := range []string{"/?status=0", "/?status=5", "/?status=13", "/"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", target, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="/"} 2
+		http_server_requests_total{code="404",handler="/"} 1
+		http_server_requests_total{code="500",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestClientClosedCode(t *testing.T) {
+	mux := NewServeMux(WithCode(), WithoutPending(), WithClientClosedCode())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	mux.HandleFunc("/flush", func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, path := range []string{"/", "/write", "/flush"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil).WithContext(ctx))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="/"} 1
+		http_server_requests_total{code="200",handler="/flush"} 2
+		http_server_requests_total{code="200",handler="/write"} 2
+		http_server_requests_total{code="499",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestPathDepth(t *testing.T) {
+	mux := NewServeMux(WithPathDepth(2), WithoutPending())
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("/api/", noop)
+	mux.HandleFunc("/static/css/", noop)
+	mux.HandleFunc("/health", noop)
+	mux.HandleFunc("/named/", noop, WithName("named"))
+	for _, path := range []string{
+		"/api/", "/api/users", "/api/users/1", "/api/users/2/posts",
+		"/static/css/main.css", "/health", "/named/x/y",
+	} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/api/"} 1
+		http_server_requests_total{handler="/api/users"} 1
+		http_server_requests_total{handler="/api/users/"} 2
+		http_server_requests_total{handler="/health"} 1
+		http_server_requests_total{handler="/static/css/"} 1
+		http_server_requests_total{handler="named"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestPathDepthHandlerName(t *testing.T) {
+	mux := NewServeMux(
+		WithPathDepth(2),
+		WithHandlerName(func(r *http.Request) string { return "route" }),
+		WithoutPending(),
+	)
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/users/1", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="route"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestDisabledMetrics(t *testing.T) {
+	mux := NewServeMux(WithCode())
+	noop := func(w http.ResponseWriter, r *http.Request) {}
+	mux.HandleFunc("/healthz", noop, WithDisabledMetrics())
+	mux.HandleFunc("/", noop)
+	for _, path := range []string{"/healthz", "/healthz", "/"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("unexpected code for %q: %d", path, w.Code)
+		}
+	}
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="/"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestDurationSampleRate(t *testing.T) {
+	values := []float64{0.1, 0.6, 0.3, 0.9}
+	mux := NewServeMux(
+		WithDuration(),
+		WithDurationBuckets([]float64{1}),
+		WithDurationSampleRate(0.5),
+		WithoutPending(),
+		withClock(func() time.Time { return time.Unix(0, 0) }),
+		withRandom(func() float64 {
+			v := values[0]
+			values = values[1:]
+			return v
+		}),
+	)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	for i := 0; i < 4; i++ {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	}
+	expect := `
+		# HELP http_server_request_duration_seconds Histogram of HTTP server request durations in seconds.
+		# TYPE http_server_request_duration_seconds histogram
+		http_server_request_duration_seconds_bucket{handler="/",le="1"} 2
+		http_server_request_duration_seconds_bucket{handler="/",le="+Inf"} 2
+		http_server_request_duration_seconds_sum{handler="/"} 0
+		http_server_request_duration_seconds_count{handler="/"} 2
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/"} 4
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect)))
+}
+
+func TestRegister(t *testing.T) {
+	mux := NewServeMux(WithDuration(), WithResponseSize())
+	reg := prometheus.NewPedanticRegistry()
+	check(t, mux.Register(reg))
+	if err := mux.Register(reg); err == nil {
+		t.Error("expected error registering metrics twice")
+	}
+}
+
+func TestWithRegisterer(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	mux := NewServeMux(WithRegisterer(reg))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_pending Number of HTTP server requests currently pending.
+		# TYPE http_server_requests_pending gauge
+		http_server_requests_pending{handler="/"} 0
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/"} 1
+	`
+	check(t, testutil.GatherAndCompare(reg, strings.NewReader(expect)))
+}
+
+func TestReset(t *testing.T) {
+	mux := NewServeMux(WithDuration(), WithResponseSize(), WithPanicRecovery())
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := testutil.CollectAndCount(mux.Collector()); n == 0 {
+		t.Fatal("expected metrics before reset")
+	}
+	mux.Reset()
+	if n := testutil.CollectAndCount(mux.Collector()); n != 0 {
+		t.Errorf("unexpected metric count after reset: %d", n)
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if n := testutil.CollectAndCount(mux.Collector(), "http_server_requests_total"); n != 1 {
+		t.Errorf("unexpected requests count after reset: %d", n)
+	}
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	mux := NewServeMux(WithCode(), WithNotFoundHandler())
+	mux.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {})
+	for _, path := range []string{"/foo", "/bar", "/baz"} {
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="/foo"} 1
+		http_server_requests_total{code="404",handler="not_found"} 2
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_requests_total"))
+}
+
+func TestNotFoundHandlerMethodNotAllowed(t *testing.T) {
+	mux := NewServeMux(WithCode(), WithNotFoundHandler())
+	mux.HandleFunc("GET /x", func(w http.ResponseWriter, r *http.Request) {})
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/x", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected code: got %d; want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if allow := w.Header().Get("Allow"); allow != "GET, HEAD" {
+		t.Errorf("unexpected Allow header: got %q; want %q", allow, "GET, HEAD")
+	}
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/y", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="404",handler="not_found"} 1
+		http_server_requests_total{code="405",handler="not_found"} 1
+	`
+	check(t, testutil.CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_requests_total"))
+}
+
+func TestSplitPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		method  string
+		path    string
+	}{
+		{"/", "", "/"},
+		{"/items/", "", "/items/"},
+		{"example.com/items/", "", "example.com/items/"},
+		{"GET /items/{id}", "GET", "/items/{id}"},
+		{"POST  example.com/items/", "POST", "example.com/items/"},
+		{"DELETE\t/items/{id}", "DELETE", "/items/{id}"},
+	}
+	for _, tt := range tests {
+		method, path := splitPattern(tt.pattern)
+		if method != tt.method || path != tt.path {
+			t.Errorf("splitPattern(%q) = %q, %q; want %q, %q", tt.pattern, method, path, tt.method, tt.path)
+		}
+	}
+}
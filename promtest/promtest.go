@@ -0,0 +1,24 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright 2021 Andrew Bursavich. All rights reserved.
+// Use of this source code is governed by The MIT License
+// which can be found in the LICENSE file.
+
+// Package promtest provides helpers for testing instrumented handlers.
+package promtest
+
+import (
+	"io"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// CollectAndCompare collects the given collector's metrics, such as those of
+// Middleware.Collector or ServeMux.Collector, and compares them to the expected
+// metrics in the Prometheus text exposition format, like
+// testutil.CollectAndCompare. If metric names are given, only those metrics
+// are compared.
+func CollectAndCompare(c prometheus.Collector, expected io.Reader, metricNames ...string) error {
+	return testutil.CollectAndCompare(c, expected, metricNames...)
+}
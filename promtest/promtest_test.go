@@ -0,0 +1,41 @@
+package promtest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bursavich.dev/httpprom"
+)
+
+func TestCollectAndCompare(t *testing.T) {
+	mw := httpprom.NewMiddleware(httpprom.WithCode())
+	h := mw.Handler("api", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{code="200",handler="api"} 1
+	`
+	if err := CollectAndCompare(mw.Collector(), strings.NewReader(expect), "http_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+	if err := CollectAndCompare(mw.Collector(), strings.NewReader(expect)); err == nil {
+		t.Error("expected error for missing pending gauge")
+	}
+}
+
+func TestCollectAndCompareServeMux(t *testing.T) {
+	mux := httpprom.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/"} 1
+	`
+	if err := CollectAndCompare(mux.Collector(), strings.NewReader(expect), "http_server_requests_total"); err != nil {
+		t.Fatal(err)
+	}
+}
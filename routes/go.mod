@@ -0,0 +1,12 @@
+module bursavich.dev/httpprom/routes
+
+go 1.16
+
+require (
+	bursavich.dev/httpprom v0.0.0-00010101000000-000000000000
+	github.com/go-chi/chi/v5 v5.0.0
+	github.com/gorilla/mux v1.8.0
+	github.com/prometheus/client_golang v1.10.0
+)
+
+replace bursavich.dev/httpprom => ../
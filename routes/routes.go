@@ -0,0 +1,59 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright 2021 Andrew Bursavich. All rights reserved.
+// Use of this source code is governed by The MIT License
+// which can be found in the LICENSE file.
+
+// Package routes provides handler name functions for third-party routers,
+// to be used with httpprom.WithHandlerName. It's a separate module, so that
+// only its users depend on the routers.
+package routes
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/mux"
+)
+
+// Unmatched is the handler name of requests without a matched route.
+const Unmatched = "unmatched"
+
+// GorillaRouteName returns the path template of the gorilla/mux route matched
+// by the request, or Unmatched if there isn't one. The middleware must be
+// added to the router with Router.Use, so that it's called after matching:
+//
+//	mw := httpprom.NewMiddleware(httpprom.WithHandlerName(routes.GorillaRouteName))
+//	router.Use(func(h http.Handler) http.Handler { return mw.Wrap(h) })
+func GorillaRouteName(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return Unmatched
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return Unmatched
+	}
+	return tpl
+}
+
+// ChiRoutePattern returns the pattern of the chi route matched by the request,
+// or Unmatched if there isn't one. Since chi matches routes after calling its
+// middleware, the middleware must be added to the router with Router.Use and
+// created with httpprom.WithDeferredName:
+//
+//	mw := httpprom.NewMiddleware(
+//		httpprom.WithHandlerName(routes.ChiRoutePattern),
+//		httpprom.WithDeferredName(),
+//	)
+//	router.Use(func(h http.Handler) http.Handler { return mw.Wrap(h) })
+func ChiRoutePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil {
+		return Unmatched
+	}
+	if pattern := rctx.RoutePattern(); pattern != "" {
+		return pattern
+	}
+	return Unmatched
+}
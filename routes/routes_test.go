@@ -0,0 +1,56 @@
+package routes
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"bursavich.dev/httpprom"
+	"github.com/go-chi/chi/v5"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestGorillaRouteName(t *testing.T) {
+	mw := httpprom.NewMiddleware(httpprom.WithHandlerName(GorillaRouteName), httpprom.WithoutPending())
+	router := mux.NewRouter()
+	router.Use(func(h http.Handler) http.Handler { return mw.Wrap(h) })
+	router.HandleFunc("/items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	for _, path := range []string{"/items/1", "/items/2"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/items/{id}"} 2
+	`
+	if err := testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)); err != nil {
+		t.Fatal(err)
+	}
+	if name := GorillaRouteName(httptest.NewRequest("GET", "/", nil)); name != Unmatched {
+		t.Errorf("GorillaRouteName() = %q; want %q", name, Unmatched)
+	}
+}
+
+func TestChiRoutePattern(t *testing.T) {
+	mw := httpprom.NewMiddleware(httpprom.WithHandlerName(ChiRoutePattern), httpprom.WithDeferredName(), httpprom.WithoutPending())
+	router := chi.NewRouter()
+	router.Use(func(h http.Handler) http.Handler { return mw.Wrap(h) })
+	router.Get("/items/{id}", func(w http.ResponseWriter, r *http.Request) {})
+	for _, path := range []string{"/items/1", "/items/2", "/other"} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	expect := `
+		# HELP http_server_requests_total Total number of HTTP server requests completed.
+		# TYPE http_server_requests_total counter
+		http_server_requests_total{handler="/items/{id}"} 2
+		http_server_requests_total{handler="unmatched"} 1
+	`
+	if err := testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect)); err != nil {
+		t.Fatal(err)
+	}
+	if name := ChiRoutePattern(httptest.NewRequest("GET", "/", nil)); name != Unmatched {
+		t.Errorf("ChiRoutePattern() = %q; want %q", name, Unmatched)
+	}
+}
@@ -0,0 +1,75 @@
+// SPDX-License-Identifier: MIT
+//
+// Copyright 2021 Andrew Bursavich. All rights reserved.
+// Use of this source code is governed by The MIT License
+// which can be found in the LICENSE file.
+
+package httpprom
+
+import (
+	"bytes"
+	"io"
+	"log"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ServerErrorCounter returns a logger to be used as an http.Server's ErrorLog
+// that counts the errors logged by the server and writes them to out, or to the
+// standard logger's output if out is nil. The errors are counted by a counter
+// with a kind label, which is "tls_handshake", "accept", "panic", "http2", or
+// "other". It panics if WithServerErrors isn't given, since the counter isn't
+// created without it.
+//
+// The server logs errors that occur outside of handlers, such as failed TLS
+// handshakes and failed calls to its listener's Accept method, and panics that
+// aren't recovered by handlers. It doesn't log requests that it rejects before
+// calling a handler, such as those with malformed or oversized headers, which it
+// responds to with 400 (Bad Request) or 431 (Request Header Fields Too Large)
+// and closes, so they aren't counted.
+//
+//	srv := &http.Server{
+//		Handler:  mux,
+//		ErrorLog: mw.ServerErrorCounter(nil),
+//	}
+func (mw *Middleware) ServerErrorCounter(out io.Writer) *log.Logger {
+	if mw.serverErrors == nil {
+		panic("httpprom: ServerErrorCounter requires WithServerErrors")
+	}
+	if out == nil {
+		out = log.Writer()
+	}
+	return log.New(&errorLogWriter{out: out, errors: mw.serverErrors}, "", log.LstdFlags)
+}
+
+// errorLogWriter counts the server errors written to it.
+type errorLogWriter struct {
+	out    io.Writer
+	errors *prometheus.CounterVec
+}
+
+func (w *errorLogWriter) Write(p []byte) (int, error) {
+	w.errors.WithLabelValues(serverErrorKind(p)).Inc()
+	return w.out.Write(p)
+}
+
+// serverErrorKinds are the kinds of errors logged by http.Server
+// with substrings of their messages.
+var serverErrorKinds = []struct {
+	kind   string
+	substr []byte
+}{
+	{"tls_handshake", []byte("http: TLS handshake error")},
+	{"accept", []byte("http: Accept error")},
+	{"panic", []byte("http: panic serving")},
+	{"http2", []byte("http2: ")},
+}
+
+func serverErrorKind(msg []byte) string {
+	for _, k := range serverErrorKinds {
+		if bytes.Contains(msg, k.substr) {
+			return k.kind
+		}
+	}
+	return "other"
+}
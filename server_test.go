@@ -0,0 +1,50 @@
+package httpprom
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServerErrorCounter(t *testing.T) {
+	mw := NewMiddleware(WithServerErrors())
+	var out bytes.Buffer
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	srv.Config.ErrorLog = mw.ServerErrorCounter(&out)
+	srv.Start()
+	defer srv.Close()
+	if resp, err := srv.Client().Get(srv.URL); err == nil {
+		resp.Body.Close()
+		t.Fatal("expected error from panicking handler")
+	}
+	srv.Config.ErrorLog.Printf("http: TLS handshake error from 127.0.0.1:1234: EOF")
+	srv.Config.ErrorLog.Printf("http: Accept error: too many open files; retrying in 5ms")
+	srv.Config.ErrorLog.Printf("http: superfluous response.WriteHeader call")
+	if !strings.Contains(out.String(), "http: panic serving") {
+		t.Errorf("expected panic to be logged: %q", out.String())
+	}
+	expect := `
+		# HELP http_server_errors_total Total number of errors logged by the HTTP server.
+		# TYPE http_server_errors_total counter
+		http_server_errors_total{kind="accept"} 1
+		http_server_errors_total{kind="other"} 1
+		http_server_errors_total{kind="panic"} 1
+		http_server_errors_total{kind="tls_handshake"} 1
+	`
+	check(t, testutil.CollectAndCompare(mw.Collector(), strings.NewReader(expect), "http_server_errors_total"))
+}
+
+func TestServerErrorCounterRequiresOption(t *testing.T) {
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("expected panic without WithServerErrors")
+		}
+	}()
+	NewMiddleware().ServerErrorCounter(nil)
+}